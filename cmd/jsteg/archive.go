@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveMagic identifies hidden data that is an archive rather than a
+// single file.
+const archiveMagic = "jstar"
+
+// An archiveEntry is a file or directory in an archive.
+type archiveEntry struct {
+	// Path is slash-separated and relative to the root of the archive.
+	Path    string
+	Mode    os.FileMode
+	ModTime time.Time
+	// Data is the contents of a file, and is empty for a directory.
+	Data []byte
+}
+
+// readArchiveDir returns the files and directories beneath dir, in lexical
+// order. Other kinds of files, such as symlinks, are skipped with a warning.
+func readArchiveDir(dir string, warn func(string)) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode() & (os.ModeDir | os.ModePerm),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.Mode().IsDir():
+		case info.Mode().IsRegular():
+			if e.Data, err = ioutil.ReadFile(p); err != nil {
+				return err
+			}
+		default:
+			warn(fmt.Sprintf("skipping %v: not a regular file or directory", p))
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// encodeArchive returns the archive containing entries. It begins with
+// archiveMagic and the number of entries, followed by the path, mode, mtime,
+// size, and contents of each. Integers are encoded as varints, and mtimes as
+// Unix seconds.
+func encodeArchive(entries []archiveEntry) []byte {
+	b := []byte(archiveMagic)
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) { b = append(b, buf[:binary.PutUvarint(buf[:], x)]...) }
+	putUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		putUvarint(uint64(len(e.Path)))
+		b = append(b, e.Path...)
+		putUvarint(uint64(e.Mode))
+		b = append(b, buf[:binary.PutVarint(buf[:], e.ModTime.Unix())]...)
+		putUvarint(uint64(len(e.Data)))
+		b = append(b, e.Data...)
+	}
+	return b
+}
+
+// decodeArchive parses an archive written by encodeArchive, rejecting any
+// entry whose path could escape the directory it is extracted into.
+func decodeArchive(b []byte) ([]archiveEntry, error) {
+	errMalformed := errors.New("archive is malformed")
+	if !strings.HasPrefix(string(b), archiveMagic) {
+		return nil, errors.New("hidden data is not an archive")
+	}
+	b = b[len(archiveMagic):]
+	uvarint := func() (uint64, bool) {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, false
+		}
+		b = b[n:]
+		return x, true
+	}
+	field := func() ([]byte, bool) {
+		n, ok := uvarint()
+		if !ok || n > uint64(len(b)) {
+			return nil, false
+		}
+		s := b[:n]
+		b = b[n:]
+		return s, true
+	}
+	n, ok := uvarint()
+	if !ok || n > uint64(len(b)) {
+		return nil, errMalformed
+	}
+	entries := make([]archiveEntry, n)
+	for i := range entries {
+		e := &entries[i]
+		name, ok := field()
+		if !ok {
+			return nil, errMalformed
+		}
+		e.Path = string(name)
+		if err := checkArchivePath(e.Path); err != nil {
+			return nil, err
+		}
+		mode, ok := uvarint()
+		if !ok || os.FileMode(mode)&^(os.ModeDir|os.ModePerm) != 0 {
+			return nil, errMalformed
+		}
+		e.Mode = os.FileMode(mode)
+		mtime, m := binary.Varint(b)
+		if m <= 0 {
+			return nil, errMalformed
+		}
+		b = b[m:]
+		e.ModTime = time.Unix(mtime, 0)
+		if e.Data, ok = field(); !ok || (e.Mode.IsDir() && len(e.Data) > 0) {
+			return nil, errMalformed
+		}
+	}
+	if len(b) > 0 {
+		return nil, errMalformed
+	}
+	return entries, nil
+}
+
+// checkArchivePath returns an error if name is not a clean, relative,
+// slash-separated path that names an entry beneath the archive's root.
+func checkArchivePath(name string) error {
+	if name == "" || name == "." || name != path.Clean(name) || path.IsAbs(name) ||
+		name == ".." || strings.HasPrefix(name, "../") ||
+		strings.ContainsAny(name, `\:`) || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("refusing to extract unsafe path %q", name)
+	}
+	return nil
+}
+
+// extractArchive writes entries beneath dir, which is created if necessary.
+// It refuses to write through symlinks that already exist beneath dir.
+func extractArchive(dir string, entries []archiveEntry) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p, err := safeJoin(dir, e.Path)
+		if err != nil {
+			return err
+		}
+		if e.Mode.IsDir() {
+			// Keep directories writable until their contents are extracted.
+			if err := os.MkdirAll(p, e.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, e.Data, e.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(p, e.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, e.ModTime, e.ModTime); err != nil {
+			return err
+		}
+	}
+	// Directories are finished last, and deepest first, since extracting
+	// their contents modifies them.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !e.Mode.IsDir() {
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.Chmod(p, e.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, e.ModTime, e.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safeJoin joins dir and name, which must have passed checkArchivePath,
+// returning an error if any existing component of the result beneath dir is
+// a symlink.
+func safeJoin(dir, name string) (string, error) {
+	p := dir
+	for _, elem := range strings.Split(name, "/") {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q through symlink %v", name, p)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// listArchive prints the contents of an archive, in the style of ls -l.
+func listArchive(entries []archiveEntry) {
+	for _, e := range entries {
+		name := e.Path
+		if e.Mode.IsDir() {
+			name += "/"
+		}
+		fmt.Printf("%v %10d %v %v\n", e.Mode, len(e.Data), e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckArchivePath(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a", true},
+		{"a/b", true},
+		{"a/b.c", true},
+		{"..a", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../x", false},
+		{"/abs", false},
+		{"a/../../b", false},
+		{"a/../b", false},
+		{"a//b", false},
+		{"a/", false},
+		{`a\b`, false},
+		{`..\x`, false},
+		{"C:x", false},
+		{"a\x00b", false},
+	}
+	for _, test := range tests {
+		if err := checkArchivePath(test.name); (err == nil) != test.ok {
+			t.Errorf("checkArchivePath(%q): expected ok=%v, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a", true},
+		{"sub", true},
+		{"sub/a", true},
+		{"new/link/a", true},
+		{"link", false},
+		{"link/a", false},
+		{"sub/link", false},
+		{"sub/link/a/b", false},
+	}
+	for _, test := range tests {
+		p, err := safeJoin(dir, test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("safeJoin(%q): expected ok=%v, got %v", test.name, test.ok, err)
+		} else if err == nil && p != filepath.Join(dir, filepath.FromSlash(test.name)) {
+			t.Errorf("safeJoin(%q): got %v", test.name, p)
+		}
+	}
+}
+
+func TestDecodeArchive(t *testing.T) {
+	entries := []archiveEntry{
+		{Path: "dir", Mode: os.ModeDir | 0755, ModTime: time.Unix(1e9, 0), Data: []byte{}},
+		{Path: "dir/a.txt", Mode: 0644, ModTime: time.Unix(-1, 0), Data: []byte("foo")},
+		{Path: "empty", Mode: 0600, ModTime: time.Unix(0, 0), Data: []byte{}},
+	}
+	b := encodeArchive(entries)
+	decoded, err := decodeArchive(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("archive did not round-trip: got %v, expected %v", decoded, entries)
+	}
+	if decoded, err := decodeArchive(encodeArchive(nil)); err != nil || len(decoded) != 0 {
+		t.Errorf("empty archive did not round-trip: %v, %v", decoded, err)
+	}
+
+	overlong := bytes.Repeat([]byte{0xff}, 11)
+	tests := []struct {
+		desc string
+		b    []byte
+	}{
+		{"not an archive", []byte("jsteg")},
+		{"missing count", []byte(archiveMagic)},
+		{"oversized count", append([]byte(archiveMagic), overlong...)},
+		{"count exceeds data", append([]byte(archiveMagic), 100)},
+		{"oversized path length", append([]byte(archiveMagic+"\x01"), overlong...)},
+		{"truncated path", []byte(archiveMagic + "\x01\x05ab")},
+		{"truncated mode", []byte(archiveMagic + "\x01\x01a")},
+		{"truncated mtime", []byte(archiveMagic + "\x01\x01a\x00")},
+		{"oversized mtime", append([]byte(archiveMagic+"\x01\x01a\x00"), overlong...)},
+		{"symlink mode", []byte(archiveMagic + "\x01\x01a\x80\x80\x80\x80\x01\x00\x00")},
+		{"unsafe path", []byte(archiveMagic + "\x01\x04../a\x00\x00\x00")},
+		{"trailing data", append(append([]byte(nil), b...), 0)},
+	}
+	for i := 1; i < len(b); i++ {
+		tests = append(tests, struct {
+			desc string
+			b    []byte
+		}{"truncated archive", b[:i]})
+	}
+	for _, test := range tests {
+		if _, err := decodeArchive(test.b); err == nil {
+			t.Errorf("%v: expected error decoding %q", test.desc, test.b)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lukechampine.com/jsteg"
+)
+
+// datasetModes are the embedding modes that the dataset command can use,
+// and the Options that hide data in each.
+var datasetModes = map[string]jsteg.Options{
+	"jsteg":       {},
+	"bits2":       {BitsPerCoefficient: 2},
+	"bits3":       {BitsPerCoefficient: 3},
+	"nonzeroac":   {Selector: jsteg.NonZeroAC},
+	"midfreq":     {Selector: jsteg.MidFrequency(6, 35)},
+	"lsbmatching": {Embedder: jsteg.LSBMatching{}},
+}
+
+// datasetModeNames returns the names of datasetModes, sorted.
+func datasetModeNames() []string {
+	names := make([]string, 0, len(datasetModes))
+	for name := range datasetModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// datasetParams are the parameters of the dataset command.
+type datasetParams struct {
+	covers, out string
+	modes       []string
+	qualities   []int
+	rates       []float64
+	seed        int64
+}
+
+// parseDatasetParams parses the comma-separated lists given to the dataset
+// command.
+func parseDatasetParams(modes, qualities, rates string) (p datasetParams, err error) {
+	for _, m := range strings.Split(modes, ",") {
+		if _, ok := datasetModes[m]; !ok {
+			return p, fmt.Errorf("unknown mode %q", m)
+		}
+		p.modes = append(p.modes, m)
+	}
+	for _, s := range strings.Split(qualities, ",") {
+		q, err := strconv.Atoi(s)
+		if err != nil || q < 1 || q > 100 {
+			return p, fmt.Errorf("invalid quality %q", s)
+		}
+		p.qualities = append(p.qualities, q)
+	}
+	for _, s := range strings.Split(rates, ",") {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 {
+			return p, fmt.Errorf("invalid payload rate %q", s)
+		}
+		p.rates = append(p.rates, r)
+	}
+	return p, nil
+}
+
+// generateDataset encodes each image in p.covers at each quality, then hides
+// a random payload in it at each rate and mode. The files, along with a
+// manifest recording the mode of each, are written to p.out. Payloads that
+// exceed the capacity of an image (in a given mode) are skipped.
+func generateDataset(p datasetParams) error {
+	entries, err := os.ReadDir(p.covers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.out, 0755); err != nil {
+		return err
+	}
+	mf, err := os.Create(filepath.Join(p.out, "manifest.csv"))
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	manifest := csv.NewWriter(mf)
+	manifest.Write([]string{"file", "cover", "label", "mode", "quality", "rate", "payload_bytes", "nonzero_ac", "capacity_bytes", "changed"})
+
+	// create writes a file to the output directory, returning its path
+	// relative to p.out.
+	create := func(mode string, img image.Image, data []byte, quality int, dir ...string) (string, jsteg.EmbedStats, error) {
+		rel := filepath.Join(dir...)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(p.out, rel)), 0755); err != nil {
+			return "", jsteg.EmbedStats{}, err
+		}
+		f, err := os.Create(filepath.Join(p.out, rel))
+		if err != nil {
+			return "", jsteg.EmbedStats{}, err
+		}
+		defer f.Close()
+		o := datasetModes[mode]
+		o.Quality = quality
+		stats, err := jsteg.HideStats(f, img, data, &o)
+		if err == nil {
+			err = f.Close()
+		}
+		return rel, stats, err
+	}
+
+	rng := rand.New(rand.NewSource(p.seed))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(p.covers, entry.Name()))
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			// not an image
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())) + ".jpg"
+		for _, quality := range p.qualities {
+			qdir := "q" + strconv.Itoa(quality)
+			cover, stats, err := create("jsteg", img, nil, quality, "cover", qdir, name)
+			if err != nil {
+				return err
+			}
+			manifest.Write([]string{cover, cover, "0", "", strconv.Itoa(quality), "0", "0",
+				strconv.Itoa(stats.NonZero), strconv.Itoa(stats.Usable / 8), "0"})
+
+			for _, rate := range p.rates {
+				rdir := "r" + strconv.FormatFloat(rate, 'f', -1, 64)
+				n := int(rate * float64(stats.NonZero) / 8)
+				for _, mode := range p.modes {
+					bits := datasetModes[mode].BitsPerCoefficient
+					if bits == 0 {
+						bits = 1
+					}
+					data := make([]byte, n)
+					rng.Read(data)
+					stego, s, err := create(mode, img, data, quality, mode, qdir, rdir, name)
+					if errors.Is(err, jsteg.ErrTooSmall) {
+						// the mode has less capacity than the cover suggests
+						os.Remove(filepath.Join(p.out, stego))
+						continue
+					} else if err != nil {
+						return fmt.Errorf("%v: %w", stego, err)
+					}
+					manifest.Write([]string{stego, cover, "1", mode, strconv.Itoa(quality), strconv.FormatFloat(rate, 'f', -1, 64), strconv.Itoa(n),
+						strconv.Itoa(s.NonZero), strconv.Itoa(s.Usable * bits / 8), strconv.Itoa(s.Changed)})
+				}
+			}
+		}
+	}
+	manifest.Flush()
+	if err := manifest.Error(); err != nil {
+		return err
+	}
+	return mf.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"lukechampine.com/jsteg"
+)
+
+// writeHistograms writes the coefficient histograms of in to path as CSV,
+// with one row per channel, zig-zag index, and value.
+func writeHistograms(path string, in *jsteg.Inspection) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"channel", "zigzag", "value", "count"})
+	for c, channel := range []string{"luma", "chroma"} {
+		for zig, hist := range in.Histograms[c] {
+			values := make([]int, 0, len(hist))
+			for v := range hist {
+				values = append(values, int(v))
+			}
+			sort.Ints(values)
+			for _, v := range values {
+				w.Write([]string{channel, strconv.Itoa(zig), strconv.Itoa(v), strconv.Itoa(hist[int32(v)])})
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeHeatmap writes a PNG to path in which each 8x8 block is colored by
+// fill(i), where i is the index of the block in in.Usable.
+func writeHeatmap(path string, in *jsteg.Inspection, fill func(i int) color.Color) error {
+	img := image.NewRGBA(image.Rect(0, 0, 8*in.BlocksX, 8*in.BlocksY))
+	for by := 0; by < in.BlocksY; by++ {
+		for bx := 0; bx < in.BlocksX; bx++ {
+			c := fill(by*in.BlocksX + bx)
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					img.Set(8*bx+x, 8*by+y, c)
+				}
+			}
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeInspection writes the histograms and heatmaps of in to dir. If n is
+// positive, it also writes a map of the blocks that carry the first n bytes of
+// hidden data.
+func writeInspection(dir string, in *jsteg.Inspection, n int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeHistograms(filepath.Join(dir, "histograms.csv"), in); err != nil {
+		return err
+	}
+	// Usable coefficients are shown from black (none) to white (the most in
+	// any block).
+	maxUsable := maxOf(in.Usable)
+	usable := func(i int) color.Color {
+		return color.Gray{uint8(in.Usable[i] * 255 / maxUsable)}
+	}
+	if err := writeHeatmap(filepath.Join(dir, "usable.png"), in, usable); err != nil {
+		return err
+	}
+	if n <= 0 {
+		return nil
+	}
+	// Blocks that carry data are shown in green, brighter if they carry more,
+	// and blocks that could have carried data are shown in gray.
+	carried := in.Carried(n)
+	maxCarried := maxOf(carried)
+	payload := func(i int) color.Color {
+		switch {
+		case carried[i] > 0:
+			return color.RGBA{0, uint8(64 + carried[i]*191/maxCarried), 0, 255}
+		case in.Usable[i] > 0:
+			return color.Gray{64}
+		default:
+			return color.Black
+		}
+	}
+	return writeHeatmap(filepath.Join(dir, "payload.png"), in, payload)
+}
+
+// maxOf returns the largest of xs, or 1 if none is greater.
+func maxOf(xs []int) int {
+	m := 1
+	for _, x := range xs {
+		if x > m {
+			m = x
+		}
+	}
+	return m
+}
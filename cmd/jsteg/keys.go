@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"lukechampine.com/jsteg"
+)
+
+// Keys are ed25519 keys, so that the identities used by slink can also
+// receive hidden data. A public key is stored as the base64 encoding of its
+// 32 bytes, and a private key as the base64 encoding of its 32-byte seed.
+// Either is converted to X25519 for encryption.
+
+// keyList is a flag that may be given more than once.
+type keyList []string
+
+func (l *keyList) String() string     { return strings.Join(*l, ",") }
+func (l *keyList) Set(s string) error { *l = append(*l, s); return nil }
+
+// decodeKey decodes a base64 key of the given size.
+func decodeKey(text []byte, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(text)))
+	if err != nil || len(key) != size {
+		return nil, errors.New("not a base64-encoded key")
+	}
+	return key, nil
+}
+
+// readKeyFile decodes the base64 key in the named file. Errors omit the
+// name, in case a key was mistakenly given in its place.
+func readKeyFile(name string, size int) ([]byte, error) {
+	text, err := ioutil.ReadFile(name)
+	if pe, ok := err.(*os.PathError); ok {
+		return nil, pe.Err
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeKey(text, size)
+}
+
+// publicKey returns the X25519 form of an ed25519 public key.
+func publicKey(key []byte, err error) (*ecdh.PublicKey, error) {
+	if err != nil {
+		return nil, err
+	}
+	return jsteg.X25519PublicKey(key)
+}
+
+// readPublicKey returns the X25519 form of the ed25519 public key in the
+// named file.
+func readPublicKey(name string) (*ecdh.PublicKey, error) {
+	return publicKey(readKeyFile(name, ed25519.PublicKeySize))
+}
+
+// parsePublicKey returns the X25519 form of the base64 ed25519 public key s.
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	return publicKey(decodeKey([]byte(s), ed25519.PublicKeySize))
+}
+
+// readPrivateKey returns the X25519 form of the ed25519 private key in the
+// named file. Private keys are only read from files, so that they do not
+// appear in the arguments of the process.
+func readPrivateKey(name string) (*ecdh.PrivateKey, error) {
+	seed, err := readKeyFile(name, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return jsteg.X25519PrivateKey(ed25519.NewKeyFromSeed(seed))
+}
+
+// readPassword returns the first line of the named file, or of stdin if name
+// is "-". Like private keys, passwords are not given on the command line,
+// where other users could see them.
+func readPassword(name string) (string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("password is empty")
+	}
+	return line, nil
+}
+
+// generateKey returns a new ed25519 keypair, derived from password as slink
+// derives it if password is non-empty.
+func generateKey(password string) (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	if password == "" {
+		return ed25519.GenerateKey(rand.Reader)
+	}
+	h := sha256.Sum256([]byte(password))
+	return ed25519.GenerateKey(bytes.NewReader(h[:]))
+}
+
+// writeKeyFiles writes the keypair to name.pub and name.key.
+func writeKeyFiles(name string, pub ed25519.PublicKey, priv ed25519.PrivateKey) error {
+	err := ioutil.WriteFile(name+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name+".key", []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdh"
 	"encoding/binary"
+	"encoding/csv"
+	"fmt"
 	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"lukechampine.com/flagg"
 	"lukechampine.com/jsteg"
@@ -14,28 +21,114 @@ import (
 
 const magic = "jsteg"
 
+// revealLimits bound the memory used by reveal, since a small compressed
+// payload can decompress to far more data than the image could carry.
+var revealLimits = jsteg.DecodeLimits{MaxPayload: 1 << 30}
+
 func main() {
 	log.SetFlags(0)
 
 	flagg.Root.Usage = flagg.SimpleUsage(flagg.Root, `Usage: jsteg [command] [args]
 
 Commands:
-    jsteg hide in.jpg [FILE] [out.jpg]
-    jsteg reveal in.jpg [FILE]
+    jsteg hide [--to KEYFILE | --to-key KEY]... in.jpg [FILE] [out.jpg]
+    jsteg hide [--to KEYFILE | --to-key KEY]... -r DIR in.jpg [out.jpg]
+    jsteg reveal [-partial | --key KEYFILE] in.jpg [FILE]
+    jsteg reveal [--key KEYFILE] -x DIR | -l in.jpg
+    jsteg keygen [-p FILE] NAME
+    jsteg detect in.jpg
+    jsteg features [-format csv|bin] [-o FILE] in.jpg...
+    jsteg dataset [flags] covers/ out/
+    jsteg inspect in.jpg out/
+    jsteg compare cover.jpg stego.jpg
 `)
 	cmdHide := flagg.New("hide", `Usage:
     jsteg hide in.jpg [FILE] [out.jpg]
       Hide FILE (or stdin) in in.jpg, writing the result to out.jpg (or stdout)
+    jsteg hide -r DIR in.jpg [out.jpg]
+      Hide the files beneath DIR in in.jpg as a compressed archive, recording
+      their paths, sizes, modes, and modification times
+
+    With --to, the hidden data is encrypted so that only the holder of the
+    private key matching one of the given public keys can reveal it. --to
+    reads a public key file written by keygen, and --to-key takes a base64
+    public key itself.
 `)
+	hideDir := cmdHide.String("r", "", "hide the files beneath `DIR` as an archive")
+	var hideTo, hideToKey keyList
+	cmdHide.Var(&hideTo, "to", "encrypt the hidden data to the public key in `KEYFILE` (may be repeated)")
+	cmdHide.Var(&hideToKey, "to-key", "encrypt the hidden data to the base64 public `KEY` (may be repeated)")
 	cmdReveal := flagg.New("reveal", `Usage:
-    jsteg reveal in.jpg [FILE]
+    jsteg reveal [-partial] in.jpg [FILE]
       Write the hidden contents of in.jpg to FILE (or stdout)
+    jsteg reveal -x DIR | -l in.jpg
+      Extract the archive hidden in in.jpg into DIR, or list its contents
+
+    With --key, hidden data encrypted to the matching public key is
+    decrypted. --key reads a private key file written by keygen; private
+    keys cannot be given on the command line.
+`)
+	revealPartial := cmdReveal.Bool("partial", false, "recover what remains of the hidden contents of a truncated or corrupt image")
+	revealExtract := cmdReveal.String("x", "", "extract the hidden archive into `DIR`")
+	revealList := cmdReveal.Bool("l", false, "list the contents of the hidden archive")
+	revealKey := cmdReveal.String("key", "", "decrypt the hidden data with the private key in `KEYFILE`")
+	cmdKeygen := flagg.New("keygen", `Usage:
+    jsteg keygen [-p FILE] NAME
+      Generate an ed25519 keypair, writing the public key to NAME.pub and
+      the private key to NAME.key. With -p, the keypair is derived from the
+      password on the first line of FILE (or stdin, if FILE is -), and is
+      the same keypair that slink derives from it.
+`)
+	keygenPassword := cmdKeygen.String("p", "", "derive the keypair from the password in `FILE`")
+	cmdDetect := flagg.New("detect", `Usage:
+    jsteg detect in.jpg
+      Estimate the probability that in.jpg contains LSB-embedded data,
+      and how much data it contains
+`)
+	cmdFeatures := flagg.New("features", fmt.Sprintf(`Usage:
+    jsteg features [-format csv|bin] [-o FILE] in.jpg...
+      Write the steganalysis feature vector of each input to FILE (or stdout).
+      The csv format has a header row and one row per image, beginning with
+      its filename. The bin format has no header; each image is written, in
+      order, as %v little-endian float32s.
+`, jsteg.FeatureDim))
+	featuresFormat := cmdFeatures.String("format", "csv", "output format (csv or bin)")
+	featuresOut := cmdFeatures.String("o", "", "output file")
+	cmdDataset := flagg.New("dataset", fmt.Sprintf(`Usage:
+    jsteg dataset [flags] covers/ out/
+      Encode each image in covers/ at each quality, and hide random payloads
+      in it at each rate and mode. Payload rates are measured in bits per
+      non-zero AC coefficient. The covers are written to
+      out/cover/qQUALITY/, the stego images to out/MODE/qQUALITY/rRATE/,
+      and their labels, modes, and statistics to out/manifest.csv. The
+      modes are %v.
+`, strings.Join(datasetModeNames(), ", ")))
+	datasetModeList := cmdDataset.String("modes", "jsteg", "comma-separated embedding modes")
+	datasetQualities := cmdDataset.String("qualities", "75", "comma-separated JPEG qualities")
+	datasetRates := cmdDataset.String("rates", "0.05,0.1,0.2,0.4", "comma-separated payload rates")
+	datasetSeed := cmdDataset.Int64("seed", 0, "seed for the random payloads")
+	cmdInspect := flagg.New("inspect", `Usage:
+    jsteg inspect in.jpg out/
+      Write the coefficient histograms of in.jpg to out/histograms.csv, and
+      a heatmap of the coefficients that can carry data to out/usable.png.
+      If in.jpg contains hidden data, also write a map of the blocks that
+      carry it to out/payload.png.
+`)
+	cmdCompare := flagg.New("compare", `Usage:
+    jsteg compare cover.jpg stego.jpg
+      Measure the differences between cover.jpg and stego.jpg
 `)
 	cmd := flagg.Parse(flagg.Tree{
 		Cmd: flagg.Root,
 		Sub: []flagg.Tree{
 			{Cmd: cmdHide},
 			{Cmd: cmdReveal},
+			{Cmd: cmdKeygen},
+			{Cmd: cmdDetect},
+			{Cmd: cmdFeatures},
+			{Cmd: cmdDataset},
+			{Cmd: cmdInspect},
+			{Cmd: cmdCompare},
 		},
 	})
 
@@ -43,50 +136,71 @@ Commands:
 	case cmdHide:
 		var in io.Reader
 		var out io.Writer
-		switch cmd.NArg() {
-		// stdin and stdout
-		case 1:
-			in, out = os.Stdin, os.Stdout
+		if *hideDir != "" {
+			switch cmd.NArg() {
+			// stdout
+			case 1:
+				out = os.Stdout
 
-		// either stdin and outfile or infile and stdout
-		case 2:
-			// detect whether we have stdin
-			// (not perfect; doesn't work with e.g. /dev/zero)
-			stat, _ := os.Stdin.Stat()
-			haveStdin := (stat.Mode() & os.ModeCharDevice) == 0
-			if haveStdin {
+			// outfile
+			case 2:
 				fout, err := os.Create(cmd.Arg(1))
 				if err != nil {
 					log.Fatalln("could not create output file:", err)
 				}
 				defer fout.Close()
-				in, out = os.Stdin, fout
-			} else {
+				out = fout
+
+			default:
+				cmdHide.Usage()
+				return
+			}
+		} else {
+			switch cmd.NArg() {
+			// stdin and stdout
+			case 1:
+				in, out = os.Stdin, os.Stdout
+
+			// either stdin and outfile or infile and stdout
+			case 2:
+				// detect whether we have stdin
+				// (not perfect; doesn't work with e.g. /dev/zero)
+				stat, _ := os.Stdin.Stat()
+				haveStdin := (stat.Mode() & os.ModeCharDevice) == 0
+				if haveStdin {
+					fout, err := os.Create(cmd.Arg(1))
+					if err != nil {
+						log.Fatalln("could not create output file:", err)
+					}
+					defer fout.Close()
+					in, out = os.Stdin, fout
+				} else {
+					fin, err := os.Open(cmd.Arg(1))
+					if err != nil {
+						log.Fatalln("could not open file:", err)
+					}
+					defer fin.Close()
+					in, out = fin, os.Stdout
+				}
+
+			// infile and outfile
+			case 3:
 				fin, err := os.Open(cmd.Arg(1))
 				if err != nil {
 					log.Fatalln("could not open file:", err)
 				}
 				defer fin.Close()
-				in, out = fin, os.Stdout
-			}
+				fout, err := os.Create(cmd.Arg(2))
+				if err != nil {
+					log.Fatalln("could not create output file:", err)
+				}
+				defer fout.Close()
+				in, out = fin, fout
 
-		// infile and outfile
-		case 3:
-			fin, err := os.Open(cmd.Arg(1))
-			if err != nil {
-				log.Fatalln("could not open file:", err)
-			}
-			defer fin.Close()
-			fout, err := os.Create(cmd.Arg(2))
-			if err != nil {
-				log.Fatalln("could not create output file:", err)
+			default:
+				cmdHide.Usage()
+				return
 			}
-			defer fout.Close()
-			in, out = fin, fout
-
-		default:
-			cmdHide.Usage()
-			return
 		}
 
 		injpg, err := os.Open(cmd.Arg(0))
@@ -98,22 +212,94 @@ Commands:
 			log.Fatalln("could not decode jpeg:", err)
 		}
 
-		text, err := ioutil.ReadAll(in)
-		if err != nil {
-			log.Fatalln("could not read input:", err)
+		var data []byte
+		var codecs []jsteg.Codec
+		if *hideDir != "" {
+			entries, err := readArchiveDir(*hideDir, func(msg string) { log.Println("warning:", msg) })
+			if err != nil {
+				log.Fatalln("could not read directory:", err)
+			}
+			// the archive is self-delimiting once the codec header is undone
+			data = encodeArchive(entries)
+			codecs = append(codecs, jsteg.Flate)
+		} else {
+			text, err := ioutil.ReadAll(in)
+			if err != nil {
+				log.Fatalln("could not read input:", err)
+			}
+			data = make([]byte, 9+len(text))
+			copy(data[:5], magic)
+			binary.LittleEndian.PutUint32(data[5:9], uint32(len(text)))
+			copy(data[9:], text)
+		}
+		if len(hideTo)+len(hideToKey) > 0 {
+			var recipients []*ecdh.PublicKey
+			for _, name := range hideTo {
+				key, err := readPublicKey(name)
+				if err != nil {
+					log.Fatalf("could not read public key %v: %v", name, err)
+				}
+				recipients = append(recipients, key)
+			}
+			for _, arg := range hideToKey {
+				key, err := parsePublicKey(arg)
+				if err != nil {
+					log.Fatalf("could not parse public key %v: %v", arg, err)
+				}
+				recipients = append(recipients, key)
+			}
+			codecs = append(codecs, jsteg.Recipients(recipients...))
 		}
 
-		data := make([]byte, 9+len(text))
-		copy(data[:5], magic)
-		binary.LittleEndian.PutUint32(data[5:9], uint32(len(text)))
-		copy(data[9:], text)
-
-		err = jsteg.Hide(out, img, data, nil)
+		err = jsteg.HideWithOptions(out, img, data, &jsteg.Options{Codecs: codecs})
 		if err != nil {
 			log.Fatalln("could not write output file:", err)
 		}
 
 	case cmdReveal:
+		opts := new(jsteg.Options)
+		if *revealKey != "" {
+			if *revealPartial {
+				cmdReveal.Usage()
+				return
+			}
+			key, err := readPrivateKey(*revealKey)
+			if err != nil {
+				log.Fatalln("could not read private key:", err)
+			}
+			// encrypted data is always framed, so it may as well be an
+			// archive
+			opts.Codecs = []jsteg.Codec{jsteg.Flate, jsteg.Recipient(key)}
+		}
+		if *revealExtract != "" || *revealList {
+			if cmd.NArg() != 1 || *revealPartial || (*revealExtract != "" && *revealList) {
+				cmdReveal.Usage()
+				return
+			}
+			if len(opts.Codecs) == 0 {
+				opts.Codecs = []jsteg.Codec{jsteg.Flate}
+			}
+			injpg, err := os.Open(cmd.Arg(0))
+			if err != nil {
+				log.Fatalln("could not open file:", err)
+			}
+			defer injpg.Close()
+			data, err := jsteg.RevealWithLimits(injpg, opts, revealLimits)
+			if err != nil {
+				log.Fatalln("could not decode jpeg:", err)
+			}
+			entries, err := decodeArchive(data)
+			if err != nil {
+				log.Fatalln("could not read hidden archive:", err)
+			}
+			if *revealList {
+				listArchive(entries)
+			} else if err := extractArchive(*revealExtract, entries); err != nil {
+				log.Fatalln("could not extract hidden archive:", err)
+			}
+			return
+		}
+
 		var out io.Writer
 		switch cmd.NArg() {
 		// stdout
@@ -140,23 +326,229 @@ Commands:
 		}
 		defer injpg.Close()
 
-		data, err := jsteg.Reveal(injpg)
-		if err != nil {
-			log.Fatalln("could not decode jpeg:", err)
+		var data []byte
+		if *revealPartial {
+			data, err = jsteg.RevealPartial(injpg, nil)
+			if err != nil {
+				log.Println("warning:", err)
+			}
+		} else {
+			data, err = jsteg.RevealWithLimits(injpg, opts, revealLimits)
+			if err != nil {
+				log.Fatalln("could not decode jpeg:", err)
+			}
 		}
-		if len(data) < 5 || string(data[:5]) != magic {
-			log.Fatalln("jpeg does not contain hidden data")
+		if strings.HasPrefix(string(data), archiveMagic) {
+			log.Fatalln("jpeg contains a hidden archive; use -x or -l")
+		} else if len(data) < 9 || string(data[:5]) != magic {
+			log.Fatalln("jpeg does not contain hidden data; archives need -x or -l, and encrypted data --key")
 		}
 		n := binary.LittleEndian.Uint32(data[5:9])
-		if n > uint32(len(data)) {
+		text := data[9:]
+		if n <= uint32(len(text)) {
+			text = text[:n]
+		} else if *revealPartial {
+			log.Printf("warning: recovered %v of %v bytes of hidden data", len(text), n)
+		} else {
 			log.Fatalln("hidden data is malformed")
 		}
-
-		text := data[9:][:n]
 		if _, err := out.Write(text); err != nil {
 			log.Fatalln("could not write hidden data:", err)
 		}
 
+	case cmdKeygen:
+		if cmd.NArg() != 1 {
+			cmdKeygen.Usage()
+			return
+		}
+		var password string
+		if *keygenPassword != "" {
+			var err error
+			if password, err = readPassword(*keygenPassword); err != nil {
+				log.Fatalln("could not read password:", err)
+			}
+		}
+		pub, priv, err := generateKey(password)
+		if err != nil {
+			log.Fatalln("could not generate key:", err)
+		}
+		if err := writeKeyFiles(cmd.Arg(0), pub, priv); err != nil {
+			log.Fatalln("could not write key:", err)
+		}
+
+	case cmdDetect:
+		if cmd.NArg() != 1 {
+			cmdDetect.Usage()
+			return
+		}
+		injpg, err := os.Open(cmd.Arg(0))
+		if err != nil {
+			log.Fatalln("could not open file:", err)
+		}
+		defer injpg.Close()
+
+		res, err := jsteg.Detect(injpg)
+		if err != nil {
+			log.Fatalln("could not decode jpeg:", err)
+		}
+		if _, err := injpg.Seek(0, io.SeekStart); err != nil {
+			log.Fatalln("could not read jpeg:", err)
+		}
+		est, err := jsteg.EstimatePayload(injpg)
+		if err != nil {
+			log.Fatalln("could not decode jpeg:", err)
+		}
+		if _, err := injpg.Seek(0, io.SeekStart); err != nil {
+			log.Fatalln("could not read jpeg:", err)
+		}
+		cal, err := jsteg.Calibrate(injpg)
+		if err != nil {
+			log.Fatalln("could not decode jpeg:", err)
+		}
+		fmt.Printf("Examined %v usable coefficients\n", res.Coefficients)
+		for i := 9; i < len(res.Progress); i += 10 {
+			fmt.Printf("  %3v%%: %6.2f%%\n", (i+1)*100/len(res.Progress), res.Progress[i]*100)
+		}
+		fmt.Printf("Embedding probability: %.2f%%\n", res.Probability*100)
+		fmt.Printf("Estimated payload: %.1f%% ± %.1f%% of capacity (~%v bytes)\n", est.Payload*100, est.Confidence*100, est.Bytes)
+		fmt.Printf("Calibrated modification rate: %.1f%% of non-zero coefficients\n", cal.Beta*100)
+
+	case cmdFeatures:
+		if cmd.NArg() == 0 || (*featuresFormat != "csv" && *featuresFormat != "bin") {
+			cmdFeatures.Usage()
+			return
+		}
+		out := os.Stdout
+		if *featuresOut != "" {
+			fout, err := os.Create(*featuresOut)
+			if err != nil {
+				log.Fatalln("could not create output file:", err)
+			}
+			defer fout.Close()
+			out = fout
+		}
+		w := bufio.NewWriter(out)
+		cw := csv.NewWriter(w)
+		row := append([]string{"file"}, jsteg.FeatureNames()...)
+		if *featuresFormat == "csv" {
+			cw.Write(row)
+		}
+		buf := make([]byte, 4*jsteg.FeatureDim)
+		for _, path := range cmd.Args() {
+			injpg, err := os.Open(path)
+			if err != nil {
+				log.Fatalln("could not open file:", err)
+			}
+			features, err := jsteg.Features(injpg)
+			injpg.Close()
+			if err != nil {
+				log.Fatalf("could not decode %v: %v", path, err)
+			}
+			if *featuresFormat == "csv" {
+				row[0] = path
+				for i, f := range features {
+					row[i+1] = strconv.FormatFloat(f, 'g', -1, 64)
+				}
+				cw.Write(row)
+			} else {
+				for i, f := range features {
+					binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(f)))
+				}
+				w.Write(buf)
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Fatalln("could not write features:", err)
+		} else if err := w.Flush(); err != nil {
+			log.Fatalln("could not write features:", err)
+		}
+
+	case cmdDataset:
+		if cmd.NArg() != 2 {
+			cmdDataset.Usage()
+			return
+		}
+		p, err := parseDatasetParams(*datasetModeList, *datasetQualities, *datasetRates)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		p.covers, p.out, p.seed = cmd.Arg(0), cmd.Arg(1), *datasetSeed
+		if err := generateDataset(p); err != nil {
+			log.Fatalln("could not generate dataset:", err)
+		}
+
+	case cmdInspect:
+		if cmd.NArg() != 2 {
+			cmdInspect.Usage()
+			return
+		}
+		injpg, err := os.Open(cmd.Arg(0))
+		if err != nil {
+			log.Fatalln("could not open file:", err)
+		}
+		defer injpg.Close()
+		in, err := jsteg.Inspect(injpg, nil)
+		if err != nil {
+			log.Fatalln("could not decode jpeg:", err)
+		}
+		if _, err := injpg.Seek(0, io.SeekStart); err != nil {
+			log.Fatalln("could not read jpeg:", err)
+		}
+		data, err := jsteg.Reveal(injpg)
+		if err != nil {
+			log.Fatalln("could not decode jpeg:", err)
+		}
+		// the payload occupies the magic, the length prefix, and the data
+		var n int
+		if len(data) >= 9 && string(data[:5]) == magic {
+			n = 9 + int(binary.LittleEndian.Uint32(data[5:9]))
+		}
+		if err := writeInspection(cmd.Arg(1), in, n); err != nil {
+			log.Fatalln("could not write inspection:", err)
+		}
+		var usable int
+		for _, u := range in.Usable {
+			usable += u
+		}
+		fmt.Printf("%vx%v luma blocks, %v usable coefficients (%v bytes)\n", in.BlocksX, in.BlocksY, usable, usable/8)
+		if n > 0 {
+			fmt.Printf("Hidden data occupies %v bytes\n", n)
+		}
+
+	case cmdCompare:
+		if cmd.NArg() != 2 {
+			cmdCompare.Usage()
+			return
+		}
+		cover, err := os.Open(cmd.Arg(0))
+		if err != nil {
+			log.Fatalln("could not open file:", err)
+		}
+		defer cover.Close()
+		stego, err := os.Open(cmd.Arg(1))
+		if err != nil {
+			log.Fatalln("could not open file:", err)
+		}
+		defer stego.Close()
+		res, err := jsteg.Compare(cover, stego)
+		if err != nil {
+			log.Fatalln("could not compare images:", err)
+		}
+		if res.Recompressed {
+			fmt.Println("Cover was re-encoded with the quantization tables of the stego image")
+		}
+		fmt.Printf("PSNR: %.2f dB\n", res.PSNR)
+		fmt.Printf("SSIM: %.4f\n", res.SSIM)
+		fmt.Printf("Size delta: %+d bytes\n", res.SizeDelta)
+		fmt.Printf("Histogram divergence: %.6f bits\n", res.Divergence)
+		fmt.Printf("Changed coefficients: %v\n", res.Changed)
+		for zig, n := range res.ChangedByIndex {
+			if n > 0 {
+				fmt.Printf("  %2v: %v\n", zig, n)
+			}
+		}
+
 	default:
 		flagg.Root.Usage()
 	}
@@ -0,0 +1,93 @@
+package jsteg
+
+import (
+	"bufio"
+	"image"
+	"io"
+)
+
+// An Encoder hides data in images, reusing its buffers across calls. A single
+// Encoder can therefore encode many images with few allocations, e.g. within
+// a worker pool. An Encoder is not safe for concurrent use.
+type Encoder struct {
+	e  encoder
+	w  io.Writer
+	bw *bufio.Writer
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	enc := new(Encoder)
+	enc.Reset(w)
+	return enc
+}
+
+// Reset discards any state and switches the Encoder to write to w.
+func (enc *Encoder) Reset(w io.Writer) {
+	enc.w = w
+	if ww, ok := w.(writer); ok {
+		enc.e.w = ww
+		return
+	}
+	if enc.bw == nil {
+		enc.bw = bufio.NewWriter(w)
+	} else {
+		enc.bw.Reset(w)
+	}
+	enc.e.w = enc.bw
+}
+
+// Hide is like HideWithOptions, writing to the Encoder's writer. Any output
+// of a previous call that failed, and was still buffered, is discarded.
+func (enc *Encoder) Hide(m image.Image, data []byte, o *Options) error {
+	if enc.e.w == enc.bw {
+		enc.bw.Reset(enc.w)
+	}
+	enc.e = encoder{w: enc.e.w, rows: enc.e.rows}
+	_, err := enc.e.hide(m, data, o)
+	return err
+}
+
+// A Decoder reveals data hidden in images, reusing its buffers across calls.
+// A Decoder is not safe for concurrent use.
+type Decoder struct {
+	// Limits bound the resources used to decode each image.
+	Limits DecodeLimits
+	// Options, if non-nil, are the Key, BitsPerCoefficient, Selector, Mask,
+	// Extractor, and Components the images were written with, and any Codecs
+	// and TrustedKeys needed to reveal their data.
+	Options *Options
+
+	d decoder
+	r io.Reader
+}
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Reset discards any state and switches the Decoder to read from r.
+func (dec *Decoder) Reset(r io.Reader) {
+	dec.r = r
+}
+
+// Reveal is like RevealWithOptions, reading from the Decoder's reader.
+// Unlike RevealWithOptions, it decodes sequentially. The returned slice is
+// only valid until the next call to Reveal.
+func (dec *Decoder) Reveal() ([]byte, error) {
+	o := dec.Options
+	if o == nil {
+		o = &Options{}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	dec.d = decoder{data: dec.d.data[:0], values: dec.d.values[:0], limits: dec.Limits}
+	dec.d.setOptions(o)
+	if _, err := dec.d.decode(dec.r, false); err != nil {
+		return nil, err
+	}
+	data, _, err := dec.d.reveal(o)
+	return data, err
+}
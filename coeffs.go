@@ -0,0 +1,218 @@
+package jsteg
+
+import (
+	"image/jpeg"
+	"io"
+)
+
+// dctImage holds the quantized DCT coefficients of a baseline JPEG.
+type dctImage struct {
+	width, height int
+	nComp         int
+	comp          [maxComponents]component
+	quant         [maxTq + 1]block // Quantization tables, in zig-zag order.
+	// blocks holds the coefficients of each component, in natural (not
+	// zig-zag) order. The blocks of component i are stored row by row, with
+	// stride(i) blocks per row.
+	blocks [maxComponents][]block
+	// ri is the restart interval, in MCUs, or 0 if there is none.
+	ri int
+
+	adobeTransformValid bool
+	adobeTransform      uint8
+}
+
+// readDCT reads a JPEG image from r and returns its DCT coefficients, along
+// with the accumulated LSBs of each block.
+func readDCT(r io.Reader) (*dctImage, []byte, error) {
+	d := decoder{keepCoeffs: true}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, nil, err
+	}
+	if d.nComp == 0 {
+		return nil, nil, jpeg.FormatError("missing SOF marker")
+	}
+	m := &dctImage{
+		width:               d.width,
+		height:              d.height,
+		nComp:               d.nComp,
+		comp:                d.comp,
+		quant:               d.quant,
+		blocks:              d.coeffs,
+		ri:                  d.ri,
+		adobeTransformValid: d.adobeTransformValid,
+		adobeTransform:      d.adobeTransform,
+	}
+	for i := 0; i < m.nComp; i++ {
+		if m.blocks[i] == nil {
+			return nil, nil, jpeg.FormatError("missing SOS marker")
+		}
+	}
+	return m, d.data, nil
+}
+
+// mcus returns the number of MCUs (Minimum Coded Units) in each dimension.
+func (m *dctImage) mcus() (mxx, myy int) {
+	h0, v0 := m.comp[0].h, m.comp[0].v
+	return (m.width + 8*h0 - 1) / (8 * h0), (m.height + 8*v0 - 1) / (8 * v0)
+}
+
+// stride returns the number of blocks in each row of component i.
+func (m *dctImage) stride(i int) int {
+	mxx, _ := m.mcus()
+	return mxx * m.comp[i].h
+}
+
+// forEachBlock calls fn on each block of m in the order that they appear in
+// an interleaved scan.
+func (m *dctImage) forEachBlock(fn func(compIndex int, b *block)) {
+	m.forEachBlockAt(func(compIndex, bx, by int, b *block) { fn(compIndex, b) })
+}
+
+// forEachBlockAt is like forEachBlock, but also passes fn the position of
+// each block within its component, in blocks.
+func (m *dctImage) forEachBlockAt(fn func(compIndex, bx, by int, b *block)) {
+	mxx, myy := m.mcus()
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			for i := 0; i < m.nComp; i++ {
+				hi, vi := m.comp[i].h, m.comp[i].v
+				for j := 0; j < hi*vi; j++ {
+					bx := hi*mx + j%hi
+					by := vi*my + j/hi
+					fn(i, bx, by, &m.blocks[i][by*mxx*hi+bx])
+				}
+			}
+		}
+	}
+}
+
+// embed hides data in the luma blocks of m, in the same order used by Hide.
+// It returns any data that did not fit.
+func (m *dctImage) embed(data []byte) []byte {
+	e := encoder{data: data}
+	m.forEachBlockAt(func(compIndex, bx, by int, b *block) {
+		if compIndex == 0 {
+			e.embed(b, compIndex, bx, by)
+		}
+	})
+	return e.data
+}
+
+// validate checks that every coefficient of m can be represented by the
+// standard Huffman tables used by the encoder.
+func (m *dctImage) validate() error {
+	for i := 0; i < m.nComp; i++ {
+		for _, b := range m.blocks[i] {
+			if b[0] < -1024 || b[0] > 1023 {
+				return jpeg.UnsupportedError("DC coefficient out of range")
+			}
+			for _, ac := range b[1:] {
+				if ac < -1023 || ac > 1023 {
+					return jpeg.UnsupportedError("AC coefficient out of range")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeDCT writes the coefficients of m to e in JPEG baseline format,
+// preserving its quantization tables and sampling factors.
+func (e *encoder) writeDCT(m *dctImage) {
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	if m.adobeTransformValid {
+		e.writeMarkerHeader(app14Marker, 2+12)
+		e.write([]byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, m.adobeTransform})
+	}
+	// Write the quantization tables actually referenced by a component,
+	// using 16-bit precision where necessary.
+	var used [maxTq + 1]bool
+	extended := false
+	for i := 0; i < m.nComp; i++ {
+		used[m.comp[i].tq] = true
+	}
+	for tq, q := range m.quant {
+		if !used[tq] {
+			continue
+		}
+		pq := 0
+		for _, x := range q {
+			if x > 255 {
+				pq = 1
+				extended = true
+			}
+		}
+		e.writeMarkerHeader(dqtMarker, 2+1+blockSize*(pq+1))
+		e.writeByte(uint8(pq<<4 | tq))
+		for _, x := range q {
+			if pq == 1 {
+				e.writeByte(uint8(x >> 8))
+			}
+			e.writeByte(uint8(x))
+		}
+	}
+	// Write the image dimensions. 16-bit quantization tables are not
+	// permitted by the baseline process, so they require the extended marker.
+	marker := uint8(sof0Marker)
+	if extended {
+		marker = sof1Marker
+	}
+	e.writeMarkerHeader(marker, 8+3*m.nComp)
+	e.buf[0] = 8 // 8-bit color.
+	e.buf[1] = uint8(m.height >> 8)
+	e.buf[2] = uint8(m.height & 0xff)
+	e.buf[3] = uint8(m.width >> 8)
+	e.buf[4] = uint8(m.width & 0xff)
+	e.buf[5] = uint8(m.nComp)
+	e.write(e.buf[:6])
+	for i := 0; i < m.nComp; i++ {
+		e.buf[0] = m.comp[i].c
+		e.buf[1] = uint8(m.comp[i].h<<4 | m.comp[i].v)
+		e.buf[2] = m.comp[i].tq
+		e.write(e.buf[:3])
+	}
+	// Write the Huffman tables.
+	e.writeDHT(m.nComp)
+	if m.ri > 0 {
+		e.writeMarkerHeader(driMarker, 4)
+		e.writeByte(uint8(m.ri >> 8))
+		e.writeByte(uint8(m.ri))
+	}
+	// Write the image data. The first component uses the luminance Huffman
+	// tables; the rest use the chrominance tables.
+	e.writeMarkerHeader(sosMarker, 6+2*m.nComp)
+	e.writeByte(uint8(m.nComp))
+	for i := 0; i < m.nComp; i++ {
+		e.writeByte(m.comp[i].c)
+		e.writeByte("\x00\x11\x11\x11"[i])
+	}
+	e.write([]byte{0x00, 0x3f, 0x00})
+	var prevDC [maxComponents]int32
+	var mcuBlocks, n int
+	for i := 0; i < m.nComp; i++ {
+		mcuBlocks += m.comp[i].h * m.comp[i].v
+	}
+	mxx, myy := m.mcus()
+	m.forEachBlock(func(compIndex int, b *block) {
+		h := huffIndexLuminanceDC
+		if compIndex > 0 {
+			h = huffIndexChrominanceDC
+		}
+		prevDC[compIndex] = e.emitBlock(b, h, prevDC[compIndex])
+		if n++; m.ri > 0 && n%(mcuBlocks*m.ri) == 0 && n < mcuBlocks*mxx*myy {
+			e.restart(n/(mcuBlocks*m.ri) - 1)
+			prevDC = [maxComponents]int32{}
+		}
+	})
+	// Pad the last byte with 1's.
+	e.emit(0x7f, 7)
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+}
@@ -0,0 +1,279 @@
+package jsteg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// A Comparison describes the differences between a cover image and a stego
+// image derived from it.
+type Comparison struct {
+	// PSNR is the peak signal-to-noise ratio of the decoded stego image,
+	// in decibels, computed over its RGB channels. It is +Inf if the images
+	// are identical.
+	PSNR float64
+	// SSIM is the mean structural similarity index of the decoded luma,
+	// computed over 7x7 windows.
+	SSIM float64
+	// Changed is the number of DCT coefficients that differ, and
+	// ChangedByIndex breaks it down by zig-zag index.
+	Changed        int
+	ChangedByIndex [blockSize]int
+	// SizeDelta is the size of the stego file minus that of the cover file,
+	// in bytes.
+	SizeDelta int
+	// Divergence is the Jensen-Shannon divergence, in bits, between the
+	// histograms of the luma AC coefficients of the two images.
+	Divergence float64
+	// Recompressed reports whether the cover had to be re-encoded with the
+	// quantization tables of the stego image before its coefficients could be
+	// compared, as is the case when Hide is given a decoded JPEG.
+	Recompressed bool
+}
+
+// Compare reads a cover and a stego JPEG image and measures the differences
+// between them, both in the pixel domain and in the DCT domain.
+//
+// If the two images share the same dimensions, sampling factors, and
+// quantization tables, as is the case for a cover encoded by Hide or a
+// stego image produced by Transform, their coefficients are compared
+// directly. Otherwise, the cover is decoded and re-encoded with the
+// quantization tables of the stego image, which must be in the 4:2:0 or
+// grayscale format produced by Hide.
+func Compare(cover, stego io.Reader) (*Comparison, error) {
+	coverBuf, err := io.ReadAll(cover)
+	if err != nil {
+		return nil, err
+	}
+	stegoBuf, err := io.ReadAll(stego)
+	if err != nil {
+		return nil, err
+	}
+	coverImg, err := jpeg.Decode(bytes.NewReader(coverBuf))
+	if err != nil {
+		return nil, err
+	}
+	stegoImg, err := jpeg.Decode(bytes.NewReader(stegoBuf))
+	if err != nil {
+		return nil, err
+	}
+	if coverImg.Bounds().Size() != stegoImg.Bounds().Size() {
+		return nil, errors.New("images have different dimensions")
+	}
+	s, _, err := readDCT(bytes.NewReader(stegoBuf))
+	if err != nil {
+		return nil, err
+	}
+	c, _, err := readDCT(bytes.NewReader(coverBuf))
+	recompressed := err != nil || !sameStructure(c, s)
+	if recompressed {
+		if c, err = recompress(coverImg, s); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Comparison{
+		PSNR:         psnr(coverImg, stegoImg),
+		SSIM:         ssim(coverImg, stegoImg),
+		SizeDelta:    len(stegoBuf) - len(coverBuf),
+		Recompressed: recompressed,
+	}
+	var hc, hs [2048]float64
+	for i := 0; i < s.nComp; i++ {
+		for j := range s.blocks[i] {
+			cb, sb := &c.blocks[i][j], &s.blocks[i][j]
+			for zig := 0; zig < blockSize; zig++ {
+				if cb[unzig[zig]] != sb[unzig[zig]] {
+					res.Changed++
+					res.ChangedByIndex[zig]++
+				}
+				if i == 0 && zig > 0 {
+					hc[clampCoeff(cb[unzig[zig]])+1024]++
+					hs[clampCoeff(sb[unzig[zig]])+1024]++
+				}
+			}
+		}
+	}
+	res.Divergence = jsDivergence(hc[:], hs[:])
+	return res, nil
+}
+
+// clampCoeff clamps x to the range of an 8-bit baseline coefficient.
+func clampCoeff(x int32) int32 {
+	if x < -1024 {
+		return -1024
+	} else if x > 1023 {
+		return 1023
+	}
+	return x
+}
+
+// sameStructure reports whether the coefficients of a and b can be compared
+// directly.
+func sameStructure(a, b *dctImage) bool {
+	if a.width != b.width || a.height != b.height || a.nComp != b.nComp {
+		return false
+	}
+	for i := 0; i < a.nComp; i++ {
+		if a.comp[i].h != b.comp[i].h || a.comp[i].v != b.comp[i].v || a.quant[a.comp[i].tq] != b.quant[b.comp[i].tq] {
+			return false
+		}
+	}
+	return true
+}
+
+// recompress encodes m with the quantization tables and format of ref, and
+// returns the resulting coefficients.
+func recompress(m image.Image, ref *dctImage) (*dctImage, error) {
+	var e encoder
+	switch {
+	case ref.nComp == 1 && ref.comp[0].h == 1 && ref.comp[0].v == 1:
+		if _, ok := m.(*image.Gray); !ok {
+			gray := image.NewGray(m.Bounds())
+			draw.Draw(gray, gray.Rect, m, gray.Rect.Min, draw.Src)
+			m = gray
+		}
+	case ref.nComp == 3 && ref.comp[1].h == 1 && ref.comp[1].v == 1 &&
+		ref.comp[2].h == 1 && ref.comp[2].v == 1 &&
+		ref.quant[ref.comp[1].tq] == ref.quant[ref.comp[2].tq]:
+		switch h, v := ref.comp[0].h, ref.comp[0].v; {
+		case h == 2 && v == 2:
+			e.sub = Subsampling420
+		case h == 2 && v == 1:
+			e.sub = Subsampling422
+		case h == 1 && v == 1:
+			e.sub = Subsampling444
+		default:
+			return nil, jpeg.UnsupportedError("stego image was not encoded by Hide")
+		}
+		if gray, ok := m.(*image.Gray); ok {
+			rgba := image.NewRGBA(gray.Rect)
+			draw.Draw(rgba, rgba.Rect, gray, gray.Rect.Min, draw.Src)
+			m = rgba
+		}
+	default:
+		return nil, jpeg.UnsupportedError("stego image was not encoded by Hide")
+	}
+
+	for i := range e.quant {
+		for zig, q := range ref.quant[ref.comp[min(i, ref.nComp-1)].tq] {
+			if q > 255 {
+				return nil, jpeg.UnsupportedError("16-bit quantization table")
+			}
+			e.quant[i][zig] = uint8(q)
+		}
+	}
+	var buf bytes.Buffer
+	e.w = bufio.NewWriter(&buf)
+	if err := e.writeImage(m); err != nil {
+		return nil, err
+	}
+	c, _, err := readDCT(&buf)
+	return c, err
+}
+
+// psnr returns the peak signal-to-noise ratio between the RGB channels of a
+// and b, which must have the same size.
+func psnr(a, b image.Image) float64 {
+	var sse float64
+	ab, bb := a.Bounds(), b.Bounds()
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r0, g0, b0, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r1, g1, b1, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range [3]float64{
+				float64(r0>>8) - float64(r1>>8),
+				float64(g0>>8) - float64(g1>>8),
+				float64(b0>>8) - float64(b1>>8),
+			} {
+				sse += d * d
+			}
+		}
+	}
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	mse := sse / float64(3*ab.Dx()*ab.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+// ssim returns the mean structural similarity index between the luma of a and
+// b, which must have the same size, using uniform 7x7 windows. Images smaller
+// than a window are treated as a single window.
+func ssim(a, b image.Image) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	ya, yb := luma(a), luma(b)
+	win := min(7, min(w, h))
+
+	var total float64
+	var n int
+	for y := 0; y+win <= h; y++ {
+		for x := 0; x+win <= w; x++ {
+			var sa, sb, saa, sbb, sab float64
+			for j := y; j < y+win; j++ {
+				for i := x; i < x+win; i++ {
+					pa, pb := ya[j*w+i], yb[j*w+i]
+					sa += pa
+					sb += pb
+					saa += pa * pa
+					sbb += pb * pb
+					sab += pa * pb
+				}
+			}
+			k := float64(win * win)
+			ma, mb := sa/k, sb/k
+			va, vb, cov := saa/k-ma*ma, sbb/k-mb*mb, sab/k-ma*mb
+			total += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	return total / float64(n)
+}
+
+// luma returns the luma channel of m, row by row.
+func luma(m image.Image) []float64 {
+	b := m.Bounds()
+	y := make([]float64, 0, b.Dx()*b.Dy())
+	for py := b.Min.Y; py < b.Max.Y; py++ {
+		for px := b.Min.X; px < b.Max.X; px++ {
+			y = append(y, float64(color.GrayModel.Convert(m.At(px, py)).(color.Gray).Y))
+		}
+	}
+	return y
+}
+
+// jsDivergence returns the Jensen-Shannon divergence, in bits, between the
+// distributions described by the histograms p and q.
+func jsDivergence(p, q []float64) float64 {
+	var sp, sq float64
+	for i := range p {
+		sp += p[i]
+		sq += q[i]
+	}
+	if sp == 0 || sq == 0 {
+		return 0
+	}
+	var d float64
+	for i := range p {
+		pi, qi := p[i]/sp, q[i]/sq
+		mi := (pi + qi) / 2
+		if pi > 0 {
+			d += pi * math.Log2(pi/mi) / 2
+		}
+		if qi > 0 {
+			d += qi * math.Log2(qi/mi) / 2
+		}
+	}
+	return d
+}
@@ -0,0 +1,56 @@
+package jsteg
+
+import (
+	"bufio"
+	"context"
+	"image"
+	"io"
+)
+
+// Progress reports how far HideContext or RevealContext has got.
+type Progress struct {
+	// Rows is the number of rows of MCUs (Minimum Coded Units) processed so
+	// far, out of TotalRows. When revealing an image with several scans, Rows
+	// starts again from zero at each scan.
+	Rows, TotalRows int
+	// Bits is the number of payload bits embedded or extracted so far.
+	Bits int
+}
+
+// HideContext is like HideWithOptions, but stops with ctx.Err() if ctx is
+// done before the image has been written, in which case w may have received
+// part of it. The context is checked after each row of MCUs. If progress is
+// non-nil, it is called after each row as well.
+func HideContext(ctx context.Context, w io.Writer, m image.Image, data []byte, o *Options, progress func(Progress)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e := encoder{workers: 1, ctx: ctx, progress: progress}
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	_, err := e.hide(m, data, o)
+	return err
+}
+
+// RevealContext is like RevealWithOptions, but stops with ctx.Err() if ctx is
+// done before the image has been decoded. The context is checked after each
+// row of MCUs. If progress is non-nil, it is called after each row as well.
+// Unlike RevealWithOptions, it decodes sequentially.
+func RevealContext(ctx context.Context, r io.Reader, o *Options, progress func(Progress)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d := decoder{workers: 1, ctx: ctx, progress: progress}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+	data, _, err := d.reveal(o)
+	return data, err
+}
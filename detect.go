@@ -0,0 +1,357 @@
+package jsteg
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// detectSteps is the number of prefixes of the coefficient stream that
+// Detect evaluates.
+const detectSteps = 100
+
+// A DetectResult is the outcome of a chi-square attack on a JPEG.
+type DetectResult struct {
+	// Probability is the estimated probability that the image contains
+	// LSB-embedded data, computed over all of its usable coefficients.
+	Probability float64
+	// Progress[i] is the embedding probability computed over the first
+	// (i+1)/len(Progress) of the usable coefficients, in the order that Hide
+	// fills them. A sequentially embedded payload shows up as a run of
+	// values near 1 that falls to 0 once the payload ends.
+	Progress []float64
+	// Coefficients is the number of usable coefficients examined.
+	Coefficients int
+}
+
+// Detect reads a JPEG image from r and performs the chi-square attack of
+// Westfeld and Pfitzmann on its luma AC coefficients. Replacing LSBs tends to
+// equalize the frequencies of each pair of values (2k, 2k+1), which the attack
+// detects by comparing the observed histogram against the expected one.
+func Detect(r io.Reader) (*DetectResult, error) {
+	m, _, err := readDCT(r)
+	if err != nil {
+		return nil, err
+	}
+	var coeffs []int32
+	m.forEachBlock(func(compIndex int, b *block) {
+		if compIndex != 0 {
+			return
+		}
+		for zig := 1; zig < blockSize; zig++ {
+			if ac := b[unzig[zig]]; ac < -1 || ac > 1 {
+				coeffs = append(coeffs, ac)
+			}
+		}
+	})
+
+	res := &DetectResult{
+		Progress:     make([]float64, detectSteps),
+		Coefficients: len(coeffs),
+	}
+	// hist[0] counts positive values and hist[1] negative values, indexed by
+	// magnitude.
+	var hist [2][1024]int
+	var i int
+	for step := range res.Progress {
+		for end := (step + 1) * len(coeffs) / detectSteps; i < end; i++ {
+			ac := coeffs[i]
+			if ac < 0 {
+				hist[1][min(int(-ac), 1023)]++
+			} else {
+				hist[0][min(int(ac), 1023)]++
+			}
+		}
+		res.Progress[step] = chiSquareProbability(&hist)
+	}
+	res.Probability = res.Progress[detectSteps-1]
+	return res, nil
+}
+
+// chiSquareProbability returns the probability that the pairs of values in
+// hist have been equalized by LSB replacement.
+func chiSquareProbability(hist *[2][1024]int) float64 {
+	var chi float64
+	var pairs int
+	for s := range hist {
+		for k := 2; k < len(hist[s]); k += 2 {
+			// Pairs whose expected frequency is too small are skipped, as
+			// they make the statistic unreliable.
+			expected := float64(hist[s][k]+hist[s][k+1]) / 2
+			if expected < 5 {
+				continue
+			}
+			d := float64(hist[s][k]) - expected
+			chi += d * d / expected
+			pairs++
+		}
+	}
+	if pairs < 2 {
+		return 0
+	}
+	return gammaQ(float64(pairs-1)/2, chi/2)
+}
+
+// gammaQ returns the regularized upper incomplete gamma function Q(a, x),
+// which is the complement of the chi-square CDF with 2a degrees of freedom
+// evaluated at 2x.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	front := math.Exp(-x + a*math.Log(x) - lg)
+	if x < a+1 {
+		// Use the series representation of P(a, x).
+		sum, del := 1/a, 1/a
+		for n := 1.0; n < 1000; n++ {
+			del *= x / (a + n)
+			sum += del
+			if math.Abs(del) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*front)
+	}
+	// Use the continued fraction representation of Q(a, x), evaluated with
+	// Lentz's method.
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1.0; n < 1000; n++ {
+		an := -n * (n - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Min(1, h*front)
+}
+
+// A PayloadEstimate is the outcome of a quantitative steganalysis of a JPEG.
+type PayloadEstimate struct {
+	// Payload is the estimated fraction of usable coefficients that carry
+	// hidden bits, in [0, 1].
+	Payload float64
+	// Confidence is the half-width of an approximate 95% confidence interval
+	// around Payload.
+	Confidence float64
+	// Bytes is the estimated size of the hidden data.
+	Bytes int
+}
+
+// EstimatePayload reads a JPEG image from r and estimates how much data was
+// hidden in its luma AC coefficients by LSB replacement.
+//
+// The estimate relies on the pairs of values (2k, 2k+1) between which LSB
+// replacement moves coefficients. The sum of each pair's frequencies is
+// unaffected by embedding, while their difference shrinks in proportion to
+// the payload. In a cover image the histogram of each DCT mode is locally
+// geometric, so the expected difference can be predicted from the slope of the
+// pair sums (and, for the first pair, the untouched frequency of ±1). Comparing
+// the observed difference against this prediction yields the payload. Like
+// other structural estimators, it is biased upwards by double compression.
+func EstimatePayload(r io.Reader) (*PayloadEstimate, error) {
+	m, _, err := readDCT(r)
+	if err != nil {
+		return nil, err
+	}
+	// hist[zig][k] counts the luma AC coefficients of each mode by magnitude.
+	var hist [blockSize][1024]float64
+	var usable int
+	m.forEachBlock(func(compIndex int, b *block) {
+		if compIndex != 0 {
+			return
+		}
+		for zig := 1; zig < blockSize; zig++ {
+			ac := b[unzig[zig]]
+			if ac < 0 {
+				ac = -ac
+			}
+			hist[zig][min(int(ac), 1023)]++
+			if ac > 1 {
+				usable++
+			}
+		}
+	})
+
+	// Estimate the payload separately for each mode, then combine the
+	// estimates, weighted by the predicted cover difference.
+	var est, weight [blockSize]float64
+	var totalWeight float64
+	for zig := 1; zig < blockSize; zig++ {
+		h := &hist[zig]
+		sum := func(k int) float64 { return h[2*k] + h[2*k+1] }
+		var observed, predicted float64
+		for k := 1; k < len(h)/2-1; k++ {
+			if sum(k) < 2 {
+				continue
+			}
+			// slope is the (negated) derivative of the log-histogram at the
+			// center of the pair, 2k+0.5.
+			var slope float64
+			if k == 1 {
+				// Fit a parabola through log h(1) and the log pair sums
+				// centered at 2.5 and 4.5.
+				if h[1] < 1 || sum(2) < 1 {
+					continue
+				}
+				x0, x1, x2 := 1.0, 2.5, 4.5
+				y0, y1, y2 := math.Log(h[1]), math.Log(sum(1)/2), math.Log(sum(2)/2)
+				slope = -(y0*(x1-x2)/((x0-x1)*(x0-x2)) + y1*(2*x1-x0-x2)/((x1-x0)*(x1-x2)) + y2*(x1-x0)/((x2-x0)*(x2-x1)))
+			} else {
+				if sum(k-1) < 1 || sum(k+1) < 1 {
+					continue
+				}
+				slope = (math.Log(sum(k-1)) - math.Log(sum(k+1))) / 4
+			}
+			observed += h[2*k] - h[2*k+1]
+			predicted += sum(k) * math.Tanh(slope/2)
+		}
+		if predicted > 0 {
+			est[zig] = 1 - observed/predicted
+			weight[zig] = predicted
+			totalWeight += predicted
+		}
+	}
+	if totalWeight == 0 {
+		return &PayloadEstimate{Confidence: 1}, nil
+	}
+	var mean, sumSq float64
+	for zig := range est {
+		mean += weight[zig] * est[zig] / totalWeight
+		sumSq += weight[zig] * weight[zig]
+	}
+	var variance float64
+	for zig := range est {
+		d := est[zig] - mean
+		variance += weight[zig] * d * d / totalWeight
+	}
+	// The effective number of independent estimates accounts for the
+	// unequal weights.
+	nEff := totalWeight * totalWeight / sumSq
+	payload := math.Max(0, math.Min(1, mean))
+	return &PayloadEstimate{
+		Payload:    payload,
+		Confidence: 1.96 * math.Sqrt(variance/nEff),
+		Bytes:      int(payload * float64(usable) / 8),
+	}, nil
+}
+
+// calibrationModes are the DCT modes, as (u, v) frequencies, used by
+// Calibrate.
+var calibrationModes = [3][2]int{{2, 1}, {1, 2}, {2, 2}}
+
+// A CalibrationResult is the outcome of a calibration attack on a JPEG.
+type CalibrationResult struct {
+	// Beta is the estimated fraction of non-zero AC coefficients that were
+	// modified by embedding.
+	Beta float64
+	// Modes holds the individual estimates for the (2,1), (1,2) and (2,2)
+	// DCT modes, whose average is Beta.
+	Modes [3]float64
+}
+
+// Calibrate reads a JPEG image from r and performs Fridrich's calibration
+// attack, which detects embedders that decrement the magnitude of
+// coefficients, such as F5. The image is decompressed, cropped by 4 pixels in
+// each direction, and recompressed with the same quantization table. Since the
+// crop breaks the block structure of the embedding, the recompressed histogram
+// approximates that of the cover, and comparing the two yields the estimate.
+func Calibrate(r io.Reader) (*CalibrationResult, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := readDCT(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	var e encoder
+	for zig, q := range m.quant[m.comp[0].tq] {
+		if q > 255 {
+			return nil, jpeg.UnsupportedError("16-bit quantization table")
+		}
+		e.quant[quantIndexLuminance][zig] = uint8(q)
+	}
+
+	// hist[i][j] and calib[i][j] count the stego and calibrated luma
+	// coefficients of calibrationModes[i] with magnitude j.
+	var hist, calib [3][3]float64
+	count := func(h *[3][3]float64, b *block) {
+		for i, mode := range calibrationModes {
+			ac := b[8*mode[1]+mode[0]]
+			if ac < 0 {
+				ac = -ac
+			}
+			if ac < 3 {
+				h[i][ac]++
+			}
+		}
+	}
+	m.forEachBlock(func(compIndex int, b *block) {
+		if compIndex == 0 {
+			count(&hist, b)
+		}
+	})
+	bounds := img.Bounds()
+	cropped := image.Rect(bounds.Min.X+4, bounds.Min.Y+4, bounds.Max.X, bounds.Max.Y)
+	var b, cb, cr block
+	for y := cropped.Min.Y; y+8 <= cropped.Max.Y; y += 8 {
+		for x := cropped.Min.X; x+8 <= cropped.Max.X; x += 8 {
+			p := image.Pt(x, y)
+			switch img := img.(type) {
+			case *image.Gray:
+				grayToY(img, p, &b)
+			case *image.YCbCr:
+				yCbCrToYCbCr(img, p, &b, &cb, &cr)
+			default:
+				toYCbCr(img, p, &b, &cb, &cr)
+			}
+			fdct(&b)
+			e.quantize(&b, quantIndexLuminance)
+			count(&calib, &b)
+		}
+	}
+
+	// Scale the calibrated histograms to the number of stego blocks.
+	var res CalibrationResult
+	for i := range calibrationModes {
+		n := hist[i][0] + hist[i][1] + hist[i][2]
+		nc := calib[i][0] + calib[i][1] + calib[i][2]
+		if nc == 0 {
+			continue
+		}
+		h, c := hist[i], calib[i]
+		for j := range c {
+			c[j] *= n / nc
+		}
+		// Minimize the squared error between the stego histogram and that
+		// of the calibrated image after embedding with rate beta.
+		den := c[1]*c[1] + (c[2]-c[1])*(c[2]-c[1])
+		if den > 0 {
+			res.Modes[i] = (c[1]*(h[0]-c[0]) + (h[1]-c[1])*(c[2]-c[1])) / den
+		}
+		res.Beta += res.Modes[i] / float64(len(calibrationModes))
+	}
+	return &res, nil
+}
@@ -0,0 +1,153 @@
+package jsteg
+
+import (
+	"errors"
+	"math/rand"
+)
+
+// A CoefficientStream is the sequence of quantized DCT coefficients of an
+// image that carry data, in the order in which they appear in the image, or
+// in the order derived from Options.Key if one is given.
+type CoefficientStream struct {
+	// Values are the quantized values of the coefficients.
+	Values []int32
+	// Costs estimate the distortion caused by changing each coefficient by
+	// one: the quantization step of the coefficient.
+	Costs []float64
+
+	sel Selector
+	pos []coeffPos
+}
+
+// coeffPos is the location of a coefficient within an image.
+type coeffPos struct {
+	comp, zig uint8
+	bx, by    int32
+}
+
+// Selected reports whether the i'th coefficient of s would still carry data
+// if its value were v.
+func (s *CoefficientStream) Selected(i int, v int32) bool {
+	p := s.pos[i]
+	if p.zig > 0 && v == 0 {
+		return false
+	}
+	return s.sel.Select(int(p.comp), int(p.zig), v, int(p.bx), int(p.by))
+}
+
+// nearest returns the value closest to the i'th coefficient of s, with the
+// same sign, whose magnitude has the same low n bits as want and that keeps it
+// selected.
+func (s *CoefficientStream) nearest(i int, want int32, n int) (int32, bool) {
+	p := s.pos[i]
+	return nearestSelected(s.sel, int(p.comp), int(p.zig), s.Values[i], want, n, int(p.bx), int(p.by))
+}
+
+// An Embedder hides data in the coefficients of an image.
+type Embedder interface {
+	// Embed hides data in s, returning the new values of its coefficients,
+	// or ErrTooSmall if s cannot hold data. It must not modify s.
+	//
+	// The Extractor sees exactly those coefficients that are still selected
+	// after embedding, in the same order. An Embedder can therefore remove
+	// a coefficient from the stream by giving it a value for which
+	// s.Selected returns false, as F5 does when it shrinks a coefficient to
+	// zero, but must otherwise keep each coefficient selected.
+	Embed(s *CoefficientStream, data []byte) ([]int32, error)
+}
+
+// An Extractor reveals the data hidden in the coefficients of an image by an
+// Embedder.
+type Extractor interface {
+	// Extract returns the data hidden in values, the coefficients of the
+	// image that carry data, in the same order as the CoefficientStream
+	// passed to Embed.
+	Extract(values []int32) []byte
+}
+
+// LSBReplacement is the Embedder and Extractor that hides each bit in the
+// least significant bit of a coefficient's magnitude, as Hide does by
+// default.
+type LSBReplacement struct{}
+
+// Embed implements Embedder.
+func (LSBReplacement) Embed(s *CoefficientStream, data []byte) ([]int32, error) {
+	if 8*len(data) > len(s.Values) {
+		return nil, ErrTooSmall
+	}
+	values := append([]int32(nil), s.Values...)
+	for i := 0; i < 8*len(data); i++ {
+		mag := abs32(values[i])
+		want := mag&^1 | int32(data[i/8]>>(i%8))&1
+		if want == mag {
+			continue
+		}
+		v, ok := s.nearest(i, want, 1)
+		if !ok {
+			return nil, errUnembeddable
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// Extract implements Extractor.
+func (LSBReplacement) Extract(values []int32) []byte {
+	return extractLSBs(values)
+}
+
+// LSBMatching is the Embedder and Extractor that hides each bit in the least
+// significant bit of a coefficient's magnitude by adding or subtracting one
+// from the coefficient, rather than by replacing the bit. Unlike replacement,
+// this does not make the counts of each pair of values 2k and 2k+1 converge,
+// which is what the chi-square attack of Detect looks for. The direction of
+// each change is pseudorandom, derived from Seed, unless only one direction
+// keeps the coefficient selected.
+type LSBMatching struct {
+	Seed int64
+}
+
+// Embed implements Embedder.
+func (l LSBMatching) Embed(s *CoefficientStream, data []byte) ([]int32, error) {
+	if 8*len(data) > len(s.Values) {
+		return nil, ErrTooSmall
+	}
+	rng := rand.New(rand.NewSource(l.Seed))
+	values := append([]int32(nil), s.Values...)
+	for i := 0; i < 8*len(data); i++ {
+		v := values[i]
+		if abs32(v)&1 == int32(data[i/8]>>(i%8))&1 {
+			continue
+		}
+		d := int32(1)
+		if rng.Intn(2) == 0 {
+			d = -1
+		}
+		switch {
+		case s.Selected(i, v+d):
+			values[i] = v + d
+		case s.Selected(i, v-d):
+			values[i] = v - d
+		default:
+			return nil, errUnembeddable
+		}
+	}
+	return values, nil
+}
+
+// Extract implements Extractor.
+func (LSBMatching) Extract(values []int32) []byte {
+	return extractLSBs(values)
+}
+
+// extractLSBs returns the least significant bits of the magnitudes of
+// values.
+func extractLSBs(values []int32) []byte {
+	data := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		data[i/8] |= byte(abs32(v)&1) << (i % 8)
+	}
+	return data
+}
+
+var errUnembeddable = errors.New("jsteg: selector rejects every value that could hold the data")
@@ -0,0 +1,127 @@
+package jsteg
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// featureT is the threshold to which coefficients are clipped when
+	// computing features, so each coefficient falls into one of 2*featureT+1
+	// bins.
+	featureT = 3
+	// featureModes is the number of AC modes, in zig-zag order, whose
+	// histograms are included in the feature vector.
+	featureModes = 20
+	featureBins  = 2*featureT + 1
+)
+
+// FeatureDim is the length of the vectors returned by Features.
+const FeatureDim = featureModes*featureBins + 4*featureBins*featureBins
+
+// Features reads a JPEG image from r and returns a vector of steganalysis
+// features computed from its quantized luma coefficients, in the style of the
+// JPEG Rich Model (JRM). Coefficients are clipped to [-3, 3] and the vector
+// consists of:
+//
+//   - the histograms of the first 20 AC modes in zig-zag order;
+//   - the co-occurrence matrix of horizontally adjacent AC coefficients
+//     within a block;
+//   - the same, for vertically adjacent coefficients;
+//   - the co-occurrence matrix of the same AC mode in horizontally adjacent
+//     blocks;
+//   - the same, for vertically adjacent blocks.
+//
+// Each histogram and matrix is normalized to sum to 1, so that images of
+// different sizes are comparable. The features are named by FeatureNames.
+func Features(r io.Reader) ([]float64, error) {
+	m, _, err := readDCT(r)
+	if err != nil {
+		return nil, err
+	}
+	clip := func(x int32) int {
+		if x < -featureT {
+			x = -featureT
+		} else if x > featureT {
+			x = featureT
+		}
+		return int(x) + featureT
+	}
+	f := make([]float64, FeatureDim)
+	hist := f[:featureModes*featureBins]
+	cooc := [4][]float64{}
+	for i := range cooc {
+		off := len(hist) + i*featureBins*featureBins
+		cooc[i] = f[off : off+featureBins*featureBins]
+	}
+
+	blocks := m.blocks[0]
+	stride := m.stride(0)
+	for i := range blocks {
+		b := &blocks[i]
+		for zig := 1; zig <= featureModes; zig++ {
+			hist[(zig-1)*featureBins+clip(b[unzig[zig]])]++
+		}
+		for v := 0; v < 8; v++ {
+			for u := 0; u < 8; u++ {
+				if u+v == 0 {
+					continue
+				}
+				x := clip(b[8*v+u])
+				if u < 7 {
+					cooc[0][x*featureBins+clip(b[8*v+u+1])]++
+				}
+				if v < 7 {
+					cooc[1][x*featureBins+clip(b[8*v+u+8])]++
+				}
+				if i%stride < stride-1 {
+					cooc[2][x*featureBins+clip(blocks[i+1][8*v+u])]++
+				}
+				if i+stride < len(blocks) {
+					cooc[3][x*featureBins+clip(blocks[i+stride][8*v+u])]++
+				}
+			}
+		}
+	}
+
+	normalize := func(s []float64) {
+		var sum float64
+		for _, x := range s {
+			sum += x
+		}
+		if sum == 0 {
+			return
+		}
+		for i := range s {
+			s[i] /= sum
+		}
+	}
+	for zig := 0; zig < featureModes; zig++ {
+		normalize(hist[zig*featureBins:][:featureBins])
+	}
+	for _, c := range cooc {
+		normalize(c)
+	}
+	return f, nil
+}
+
+// FeatureNames returns the names of the features returned by Features, in
+// order. For example, "h5[-1]" is the frequency of -1 in the fifth AC mode,
+// and "intra_h[2,0]" is the frequency of a 2 followed horizontally by a 0
+// within a block.
+func FeatureNames() []string {
+	names := make([]string, 0, FeatureDim)
+	for zig := 1; zig <= featureModes; zig++ {
+		for x := -featureT; x <= featureT; x++ {
+			names = append(names, fmt.Sprintf("h%d[%d]", zig, x))
+		}
+	}
+	for _, c := range []string{"intra_h", "intra_v", "inter_h", "inter_v"} {
+		for x := -featureT; x <= featureT; x++ {
+			for y := -featureT; y <= featureT; y++ {
+				names = append(names, fmt.Sprintf("%s[%d,%d]", c, x, y))
+			}
+		}
+	}
+	return names
+}
@@ -1,5 +1,5 @@
 module lukechampine.com/jsteg
 
-go 1.17
+go 1.20
 
 require lukechampine.com/flagg v1.1.1
@@ -0,0 +1,133 @@
+package jsteg
+
+import (
+	"image"
+	"io"
+)
+
+// An Inspection describes the coefficients of a JPEG and where data can be
+// hidden in them.
+type Inspection struct {
+	// Histograms[0] counts the values of the luma coefficients, and
+	// Histograms[1] those of the chroma coefficients, by zig-zag index.
+	Histograms [2][blockSize]map[int32]int
+	// BlocksX and BlocksY are the dimensions of the grid of luma blocks,
+	// including any padding blocks in partial MCUs.
+	BlocksX, BlocksY int
+	// Usable[by*BlocksX+bx] is the number of coefficients in the luma block at
+	// (bx, by) that can carry data.
+	Usable []int
+
+	// slots holds, for each usable coefficient in the order that Hide fills
+	// them, the index of its luma block, or -1 if it is in a chroma block.
+	slots []int32
+	// per is the number of bits each usable coefficient carries, and key
+	// the key that scatters them.
+	per int
+	key []byte
+}
+
+// Inspect reads a JPEG image from r and returns its coefficient histograms and
+// usable coefficients. The usable coefficients, and the blocks that carry
+// data, are those used by Hide with the same Options; nil Options are treated
+// as the default.
+func Inspect(r io.Reader, o *Options) (*Inspection, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	m, _, err := readDCT(r)
+	if err != nil {
+		return nil, err
+	}
+	_, myy := m.mcus()
+	in := &Inspection{
+		BlocksX: m.stride(0),
+		BlocksY: myy * m.comp[0].v,
+		Usable:  make([]int, len(m.blocks[0])),
+		per:     o.bitsPerCoefficient(),
+		key:     o.Key,
+	}
+	if o.Embedder != nil {
+		// Embedders are passed one coefficient per bit, permuted by the key.
+		in.per = 1
+	}
+	for i := range in.Histograms {
+		for zig := range in.Histograms[i] {
+			in.Histograms[i][zig] = make(map[int32]int)
+		}
+	}
+	m.forEachBlock(func(compIndex int, b *block) {
+		hist := &in.Histograms[min(compIndex, 1)]
+		for zig := 0; zig < blockSize; zig++ {
+			hist[zig][b[unzig[zig]]]++
+		}
+	})
+	comps := o.components()
+	sel := m.selector(o)
+	m.forEachBlockAt(func(c, bx, by int, b *block) {
+		if c >= 3 || comps&(1<<c) == 0 {
+			return
+		}
+		slot := int32(-1)
+		if c == 0 {
+			slot = int32(by*in.BlocksX + bx)
+		}
+		for zig := 0; zig < blockSize; zig++ {
+			if v := b[unzig[zig]]; (zig == 0 || v != 0) && sel.Select(c, zig, v, bx, by) {
+				in.slots = append(in.slots, slot)
+				if slot >= 0 {
+					in.Usable[slot]++
+				}
+			}
+		}
+	})
+	return in, nil
+}
+
+// selector returns the Selector of o, restricted to the blocks of m allowed
+// by o.Mask.
+func (m *dctImage) selector(o *Options) Selector {
+	sel := o.Selector
+	if sel == nil {
+		sel = JSteg
+	}
+	if o.Mask == nil {
+		return sel
+	}
+	mxx, myy := m.mcus()
+	h0, v0 := m.comp[0].h, m.comp[0].v
+	var grid, scale [3]image.Point
+	for i := 0; i < m.nComp && i < len(grid); i++ {
+		h, v := m.comp[i].h, m.comp[i].v
+		grid[i] = image.Pt(mxx*h, myy*v)
+		scale[i] = image.Pt(h0/h, v0/v)
+	}
+	return newMaskedSelector(sel, o.Mask, m.width, m.height, grid, scale)
+}
+
+// Carried returns the number of bits carried by each luma block, indexed like
+// Usable, if n bytes of data were hidden in the image by Hide. n counts the
+// data as embedded, after any Codecs and signature are applied.
+func (in *Inspection) Carried(n int) []int {
+	carried := make([]int, len(in.Usable))
+	total := len(in.slots) * in.per
+	bits := min(8*n, total)
+	add := func(s int) {
+		if slot := in.slots[s/in.per]; slot >= 0 {
+			carried[slot]++
+		}
+	}
+	if len(in.key) == 0 {
+		for s := 0; s < bits; s++ {
+			add(s)
+		}
+		return carried
+	}
+	for _, s := range keyedOrder(in.key, total, bits) {
+		add(int(s))
+	}
+	return carried
+}
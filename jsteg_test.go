@@ -1,9 +1,21 @@
 package jsteg
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"image"
 	"image/jpeg"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -17,7 +29,14 @@ func loadTestImages(t *testing.T) []string {
 	if err != nil {
 		t.Fatal(err)
 	}
-	return names
+	// skip the fuzz corpus
+	jpegs := names[:0]
+	for _, name := range names {
+		if strings.HasSuffix(name, ".jpeg") {
+			jpegs = append(jpegs, name)
+		}
+	}
+	return jpegs
 }
 
 func TestHideReveal(t *testing.T) {
@@ -123,3 +142,1640 @@ func TestTooSmall(t *testing.T) {
 		t.Fatal("expected ErrTooSmall, got", err)
 	}
 }
+
+func TestDetect(t *testing.T) {
+	f, err := os.Open("testdata/video-001.q50.444.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cover image should not be detected
+	var buf bytes.Buffer
+	if err := Hide(&buf, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Detect(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Probability > 0.1 {
+		t.Error("cover image detected with probability", res.Probability)
+	}
+
+	// a fully-embedded image should be
+	data := make([]byte, Capacity(img, nil))
+	rand.New(rand.NewSource(0)).Read(data)
+	buf.Reset()
+	if err := Hide(&buf, img, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Detect(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Probability < 0.9 {
+		t.Error("stego image detected with probability", res.Probability)
+	}
+}
+
+// largeCover returns a 584x396 image tiled from mirrored copies of a test
+// image. The copies are offset so that their blocks do not align with those of
+// the original, which would otherwise leave traces of double compression.
+func largeCover(t *testing.T) image.Image {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := src.Bounds()
+	w, h := b.Dx()-4, b.Dy()-4
+	img := image.NewRGBA(image.Rect(0, 0, 4*w, 4*h))
+	for y := 0; y < 4*h; y++ {
+		for x := 0; x < 4*w; x++ {
+			sx, sy := x%w+2, y%h+2
+			if (x/w)%2 == 1 {
+				sx = b.Dx() - 1 - sx
+			}
+			if (y/h)%2 == 1 {
+				sy = b.Dy() - 1 - sy
+			}
+			img.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return img
+}
+
+func TestEstimatePayload(t *testing.T) {
+	img := largeCover(t)
+	capacity := Capacity(img, nil)
+	for _, rate := range []float64{0, 0.5, 1} {
+		data := make([]byte, int(rate*float64(capacity)))
+		rand.New(rand.NewSource(0)).Read(data)
+		var buf bytes.Buffer
+		if err := Hide(&buf, img, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		est, err := EstimatePayload(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(est.Payload-rate) > 0.2 {
+			t.Errorf("estimated payload of %v for rate %v (±%v)", est.Payload, rate, est.Confidence)
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	img := largeCover(t)
+	var cover bytes.Buffer
+	if err := Hide(&cover, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var betas []float64
+	for _, beta := range []float64{0, 0.2} {
+		// simulate F5 by decrementing the magnitude of a fraction of the
+		// non-zero luma AC coefficients
+		m, _, err := readDCT(bytes.NewReader(cover.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rng := rand.New(rand.NewSource(0))
+		m.forEachBlock(func(compIndex int, b *block) {
+			for i := 1; i < blockSize && compIndex == 0; i++ {
+				if b[i] != 0 && rng.Float64() < beta {
+					if b[i] > 0 {
+						b[i]--
+					} else {
+						b[i]++
+					}
+				}
+			}
+		})
+		var buf bytes.Buffer
+		e := encoder{w: bufio.NewWriter(&buf)}
+		e.writeDCT(m)
+		if e.err != nil {
+			t.Fatal(e.err)
+		}
+
+		res, err := Calibrate(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		betas = append(betas, res.Beta)
+	}
+	// calibration is biased by the test image's prior compression, so only
+	// check the response to embedding
+	if d := betas[1] - betas[0]; math.Abs(d-0.2) > 0.1 {
+		t.Errorf("estimated beta increased by %v, expected 0.2", d)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	f, err := os.Open("testdata/video-001.q50.444.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features := func(data []byte) []float64 {
+		var buf bytes.Buffer
+		if err := Hide(&buf, img, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		v, err := Features(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	cover := features(nil)
+	if len(cover) != FeatureDim || len(FeatureNames()) != FeatureDim {
+		t.Fatalf("expected %v features, got %v values and %v names", FeatureDim, len(cover), len(FeatureNames()))
+	}
+	var sum float64
+	for _, x := range cover {
+		sum += x
+	}
+	if want := float64(featureModes + 4); math.Abs(sum-want) > 1e-9 {
+		t.Errorf("features sum to %v, expected %v", sum, want)
+	}
+
+	// embedding should perturb the features
+	data := make([]byte, Capacity(img, nil))
+	rand.New(rand.NewSource(0)).Read(data)
+	stego := features(data)
+	var dist float64
+	for i := range cover {
+		dist += math.Abs(stego[i] - cover[i])
+	}
+	if dist == 0 {
+		t.Error("embedding did not change features")
+	}
+}
+
+func TestHideStats(t *testing.T) {
+	f, err := os.Open("testdata/video-001.q50.444.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, Capacity(img, nil)/2)
+	rand.New(rand.NewSource(0)).Read(data)
+	stats, err := HideStats(io.Discard, img, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Usable/8 != Capacity(img, nil) {
+		t.Errorf("usable coefficients (%v) do not match capacity (%v bytes)", stats.Usable, Capacity(img, nil))
+	} else if stats.NonZero < stats.Usable {
+		t.Errorf("fewer non-zero coefficients (%v) than usable (%v)", stats.NonZero, stats.Usable)
+	} else if stats.Embedded != 8*len(data) {
+		t.Errorf("embedded %v bits, expected %v", stats.Embedded, 8*len(data))
+	} else if r := float64(stats.Changed) / float64(stats.Embedded); r < 0.4 || r > 0.6 {
+		t.Errorf("changed %v of embedded coefficients, expected about half", r)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, Capacity(img, nil)/3)
+	rand.New(rand.NewSource(0)).Read(data)
+	var buf bytes.Buffer
+	if err := Hide(&buf, img, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	in, err := Inspect(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.Usable) != in.BlocksX*in.BlocksY {
+		t.Fatalf("expected %vx%v blocks, got %v", in.BlocksX, in.BlocksY, len(in.Usable))
+	}
+	var usable, carried, n int
+	for i, c := range in.Carried(len(data)) {
+		usable += in.Usable[i]
+		carried += c
+		if c > in.Usable[i] {
+			t.Errorf("block %v carries %v bits, but only %v are usable", i, c, in.Usable[i])
+		}
+	}
+	for _, count := range in.Histograms[0][1] {
+		n += count
+	}
+	if usable/8 != Capacity(img, nil) {
+		t.Errorf("usable coefficients (%v) do not match capacity (%v bytes)", usable, Capacity(img, nil))
+	} else if carried != 8*len(data) {
+		t.Errorf("blocks carry %v bits, expected %v", carried, 8*len(data))
+	} else if n != len(in.Usable) {
+		t.Errorf("luma histogram counts %v blocks, expected %v", n, len(in.Usable))
+	}
+
+	// the blocks that change must be those that carry data with the options
+	left := func(comp int, r image.Rectangle) bool { return r.Max.X <= img.Bounds().Dx()/2 }
+	for _, o := range []*Options{
+		{Key: []byte("foo"), BitsPerCoefficient: 2, Selector: NonZeroAC, Mask: left},
+		{Key: []byte("foo"), Embedder: LSBMatching{}},
+	} {
+		data := make([]byte, CapacityWithOptions(img, o)/4)
+		rand.New(rand.NewSource(0)).Read(data)
+		var cover, stego bytes.Buffer
+		if err := HideWithOptions(&cover, img, nil, o); err != nil {
+			t.Fatal(err)
+		} else if err := HideWithOptions(&stego, img, data, o); err != nil {
+			t.Fatal(err)
+		}
+		in, err := Inspect(bytes.NewReader(stego.Bytes()), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _, err := readDCT(&cover)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _, err := readDCT(&stego)
+		if err != nil {
+			t.Fatal(err)
+		}
+		carried := in.Carried(len(data))
+		var total, changed int
+		for i, bits := range carried {
+			total += bits
+			if c.blocks[0][i] != s.blocks[0][i] {
+				changed++
+				if bits == 0 {
+					t.Errorf("block %v changed, but carries no data", i)
+				}
+			}
+		}
+		if total != 8*len(data) {
+			t.Errorf("blocks carry %v bits, expected %v", total, 8*len(data))
+		} else if changed == 0 {
+			t.Error("no blocks changed")
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	orig, err := os.ReadFile("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cover, stego bytes.Buffer
+	if err := Hide(&cover, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, Capacity(img, nil))
+	rand.New(rand.NewSource(0)).Read(data)
+	stats, err := HideStats(&stego, img, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// whether the cover is the original file or was re-encoded by Hide, the
+	// changed coefficients should be exactly those changed by embedding
+	for _, c := range [][]byte{orig, cover.Bytes()} {
+		res, err := Compare(bytes.NewReader(c), bytes.NewReader(stego.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Recompressed != bytes.Equal(c, orig) {
+			t.Errorf("expected Recompressed to be %v", !res.Recompressed)
+		}
+		if res.Changed != stats.Changed || res.ChangedByIndex[0] != 0 {
+			t.Errorf("expected %v changed AC coefficients, got %v (%v DC)", stats.Changed, res.Changed, res.ChangedByIndex[0])
+		}
+		if res.PSNR < 25 || res.SSIM < 0.8 || res.SSIM > 1 {
+			t.Errorf("unexpectedly low quality: PSNR %v, SSIM %v", res.PSNR, res.SSIM)
+		}
+		if res.Divergence <= 0 {
+			t.Error("expected non-zero divergence")
+		}
+	}
+
+	// an image compared to itself should be identical
+	res, err := Compare(bytes.NewReader(cover.Bytes()), bytes.NewReader(cover.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed != 0 || !math.IsInf(res.PSNR, 1) || res.SSIM != 1 || res.Divergence != 0 {
+		t.Errorf("image differs from itself: %+v", res)
+	}
+
+	// the original is recompressed with the subsampling of the stego image
+	for _, sub := range []Subsampling{Subsampling420, Subsampling422, Subsampling444} {
+		o := &Options{Subsampling: sub}
+		data := make([]byte, CapacityWithOptions(img, o)/2)
+		rand.New(rand.NewSource(0)).Read(data)
+		var stego bytes.Buffer
+		stats, err := HideStats(&stego, img, data, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Compare(bytes.NewReader(orig), bytes.NewReader(stego.Bytes()))
+		if err != nil {
+			t.Errorf("subsampling %v: %v", sub, err)
+		} else if !res.Recompressed || res.Changed != stats.Changed {
+			t.Errorf("subsampling %v: expected %v changed coefficients after recompression, got %v", sub, stats.Changed, res.Changed)
+		}
+	}
+}
+
+func TestHideParallel(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ycbcr, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(ycbcr.Bounds())
+	gray := image.NewGray(ycbcr.Bounds())
+	for y := ycbcr.Bounds().Min.Y; y < ycbcr.Bounds().Max.Y; y++ {
+		for x := ycbcr.Bounds().Min.X; x < ycbcr.Bounds().Max.X; x++ {
+			rgba.Set(x, y, ycbcr.At(x, y))
+			gray.Set(x, y, ycbcr.At(x, y))
+		}
+	}
+	for _, img := range []image.Image{ycbcr, rgba, gray, largeCover(t)} {
+		data := make([]byte, Capacity(img, nil))
+		rand.New(rand.NewSource(0)).Read(data)
+		var seq bytes.Buffer
+		if err := Hide(&seq, img, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{0, 2, 3, 8} {
+			var par bytes.Buffer
+			if err := HideParallel(&par, img, data, nil, workers); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(seq.Bytes(), par.Bytes()) {
+				t.Errorf("%T: output with %v workers differs from sequential output", img, workers)
+			}
+		}
+	}
+}
+
+func BenchmarkHide(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 2048, 2048))
+	rand.New(rand.NewSource(0)).Read(img.Pix)
+	data := make([]byte, 1<<16)
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Hide(io.Discard, img, data, nil)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			HideParallel(io.Discard, img, data, nil, 0)
+		}
+	})
+}
+
+// benchImages returns a set of small images with hidden data, along with
+// their encodings.
+func benchImages(b *testing.B) ([]image.Image, [][]byte) {
+	var imgs []image.Image
+	var files [][]byte
+	for _, file := range []string{"video-001.jpeg", "video-001.q50.444.jpeg", "video-005.gray.jpeg"} {
+		f, err := os.Open("testdata/" + file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := Hide(&buf, img, []byte("hello, world"), nil); err != nil {
+			b.Fatal(err)
+		}
+		imgs = append(imgs, img)
+		files = append(files, buf.Bytes())
+	}
+	return imgs, files
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	imgs, _ := benchImages(b)
+	data := []byte("hello, world")
+	b.Run("Hide", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			Hide(io.Discard, imgs[i%len(imgs)], data, nil)
+		}
+	})
+	b.Run("Encoder", func(b *testing.B) {
+		b.ReportAllocs()
+		enc := NewEncoder(io.Discard)
+		for i := 0; i < b.N; i++ {
+			enc.Reset(io.Discard)
+			enc.Hide(imgs[i%len(imgs)], data, nil)
+		}
+	})
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	_, files := benchImages(b)
+	b.Run("Reveal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			Reveal(bytes.NewReader(files[i%len(files)]))
+		}
+	})
+	b.Run("Decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		dec := NewDecoder(nil)
+		r := new(bytes.Reader)
+		for i := 0; i < b.N; i++ {
+			r.Reset(files[i%len(files)])
+			dec.Reset(r)
+			dec.Reveal()
+		}
+	})
+}
+
+func TestRevealRestart(t *testing.T) {
+	for _, file := range []string{"video-001.jpeg", "video-001.q50.444.jpeg", "video-005.gray.jpeg"} {
+		f, err := os.Open("testdata/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, Capacity(img, nil))
+		rand.New(rand.NewSource(0)).Read(data)
+		var buf bytes.Buffer
+		if err := Hide(&buf, img, data, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, ri := range []int{1, 3, 7, 100} {
+			m, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.ri = ri
+			var rbuf bytes.Buffer
+			e := encoder{w: bufio.NewWriter(&rbuf)}
+			e.writeDCT(m)
+			if e.err != nil {
+				t.Fatal(e.err)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(rbuf.Bytes())); err != nil {
+				t.Fatalf("%v, ri=%v: %v", file, ri, err)
+			}
+			var seq []byte
+			for _, workers := range []int{1, 2, 5} {
+				d := decoder{workers: workers, keepCoeffs: true}
+				if _, err := d.decode(bytes.NewReader(rbuf.Bytes()), false); err != nil {
+					t.Fatalf("%v, ri=%v, workers=%v: %v", file, ri, workers, err)
+				}
+				if workers == 1 {
+					seq = d.data
+				}
+				if !bytes.HasPrefix(d.data, data) || !bytes.Equal(d.data, seq) {
+					t.Errorf("%v, ri=%v, workers=%v: revealed data does not match", file, ri, workers)
+				}
+				for i := 0; i < m.nComp; i++ {
+					for j := range m.blocks[i] {
+						if d.coeffs[i][j] != m.blocks[i][j] {
+							t.Fatalf("%v, ri=%v, workers=%v: coefficients do not match", file, ri, workers)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var imgs []image.Image
+	for _, file := range []string{"video-001.jpeg", "video-005.gray.jpeg", "video-001.q50.444.jpeg"} {
+		f, err := os.Open("testdata/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs = append(imgs, img)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	dec := NewDecoder(nil)
+	for i, img := range append(imgs, imgs...) {
+		data := make([]byte, Capacity(img, nil))
+		rand.New(rand.NewSource(int64(i))).Read(data)
+
+		// a failed call should not affect the next one
+		buf.Reset()
+		if err := enc.Hide(img, append(data, 0), nil); err != ErrTooSmall {
+			t.Fatal("expected ErrTooSmall, got", err)
+		}
+
+		var want bytes.Buffer
+		if err := Hide(&want, img, data, nil); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		enc.Reset(&buf)
+		if err := enc.Hide(img, data, nil); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+			t.Fatalf("image %v: Encoder output differs from Hide", i)
+		}
+
+		// nor should it without a Reset in between, even if it left output
+		// buffered
+		if err := enc.Hide(img, append(data, 0), nil); err != ErrTooSmall {
+			t.Fatal("expected ErrTooSmall, got", err)
+		}
+		buf.Reset()
+		if err := enc.Hide(img, data, nil); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+			t.Fatalf("image %v: Encoder output after a failed call differs from Hide", i)
+		} else if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("image %v: Encoder output after a failed call does not decode: %v", i, err)
+		}
+
+		dec.Reset(bytes.NewReader(buf.Bytes()))
+		got, err := dec.Reveal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, _ := Reveal(bytes.NewReader(buf.Bytes()))
+		if !bytes.Equal(got, exp) || !bytes.HasPrefix(got, data) {
+			t.Fatalf("image %v: Decoder output differs from Reveal", i)
+		}
+	}
+}
+
+func TestRevealLimits(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Hide(&buf, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// add a restart interval, so that the image has multiple segments
+	m, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ri = 4
+	buf.Reset()
+	e := encoder{w: bufio.NewWriter(&buf)}
+	e.writeDCT(m)
+	mxx, myy := m.mcus()
+	segments := (mxx*myy + m.ri - 1) / m.ri
+	full, err := Reveal(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		limits DecodeLimits
+		err    error
+	}{
+		{DecodeLimits{}, nil},
+		{DecodeLimits{MaxPixels: m.width * m.height}, nil},
+		{DecodeLimits{MaxPixels: m.width*m.height - 1}, LimitError("pixel count")},
+		{DecodeLimits{MaxPayload: len(full)}, nil},
+		{DecodeLimits{MaxPayload: len(full) - 1}, LimitError("payload size")},
+		{DecodeLimits{MaxMarkers: 3}, LimitError("marker count")},
+		{DecodeLimits{MaxSegments: segments}, nil},
+		{DecodeLimits{MaxSegments: segments - 1}, LimitError("segment count")},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{1, 4} {
+			d := decoder{workers: workers, limits: test.limits}
+			_, err := d.decode(bytes.NewReader(buf.Bytes()), false)
+			if err != test.err {
+				t.Errorf("%+v, %v workers: expected %v, got %v", test.limits, workers, test.err, err)
+			} else if err == nil && !bytes.Equal(d.data, full) {
+				t.Errorf("%+v, %v workers: revealed data does not match", test.limits, workers)
+			}
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	rand.Read(data)
+	var want bytes.Buffer
+	if err := Hide(&want, img, data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// progress should be monotonic and end with the whole image and payload
+	var last Progress
+	checkProgress := func(p Progress) {
+		if p.Rows <= last.Rows || p.Bits < last.Bits || p.Rows > p.TotalRows {
+			t.Errorf("bad progress %+v after %+v", p, last)
+		}
+		last = p
+	}
+	var buf bytes.Buffer
+	if err := HideContext(context.Background(), &buf, img, data, nil, checkProgress); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Error("HideContext output differs from Hide")
+	} else if last.Rows != last.TotalRows || last.Bits != 8*len(data) {
+		t.Errorf("bad final progress %+v", last)
+	}
+	last = Progress{}
+	revealed, err := RevealContext(context.Background(), bytes.NewReader(buf.Bytes()), nil, checkProgress)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(revealed[:len(data)], data) {
+		t.Error("revealed data does not match")
+	} else if last.Rows != last.TotalRows || last.Bits <= 8*(len(revealed)-1) || last.Bits > 8*len(revealed) {
+		t.Errorf("bad final progress %+v for %v revealed bytes", last, len(revealed))
+	}
+
+	// cancelling should stop both, including a parallel encoder
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelAt := func(p Progress) {
+		if p.Rows == 2 {
+			cancel()
+		} else if p.Rows > 2 {
+			t.Errorf("progress reported after cancellation: %+v", p)
+		}
+	}
+	if err := HideContext(ctx, io.Discard, img, data, nil, cancelAt); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	e := encoder{w: bufio.NewWriter(io.Discard), workers: 4, ctx: ctx, progress: cancelAt}
+	if _, err := e.hide(img, data, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, err := RevealContext(ctx, bytes.NewReader(buf.Bytes()), nil, cancelAt); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	cancel()
+	if _, err := RevealContext(ctx, bytes.NewReader(buf.Bytes()), nil, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRevealPartial(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Hide(&buf, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	full, err := RevealPartial(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prevLen, prevMCU int
+	for _, frac := range []float64{0.25, 0.5, 0.75, 0.99} {
+		n := int(frac * float64(buf.Len()))
+		data, err := RevealPartial(bytes.NewReader(buf.Bytes()[:n]), nil)
+		pe, ok := err.(*PartialError)
+		if !ok {
+			t.Fatalf("truncated at %v: expected *PartialError, got %v", n, err)
+		} else if pe.Offset <= 0 || pe.Offset > int64(n) {
+			t.Errorf("truncated at %v: bad offset %v", n, pe.Offset)
+		} else if pe.MCU <= prevMCU {
+			t.Errorf("truncated at %v: MCU %v did not advance past %v", n, pe.MCU, prevMCU)
+		}
+		if len(data) <= prevLen || !bytes.HasPrefix(full, data[:len(data)-1]) {
+			t.Errorf("truncated at %v: recovered %v bytes, not a prefix of the payload", n, len(data))
+		}
+		prevLen, prevMCU = len(data), pe.MCU
+	}
+
+	// truncating the header yields no data
+	data, err := RevealPartial(bytes.NewReader(buf.Bytes()[:100]), nil)
+	if pe, ok := err.(*PartialError); !ok || pe.MCU != -1 || len(data) != 0 {
+		t.Errorf("truncated header: got %v bytes, %v", len(data), err)
+	}
+}
+
+func TestRevealTolerant(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Hide(&buf, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ri = 4
+	buf.Reset()
+	e := encoder{w: bufio.NewWriter(&buf)}
+	e.writeDCT(m)
+	clean, err := RevealTolerant(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(clean.Gaps) != 0 {
+		t.Fatalf("clean image has gaps: %+v", clean.Gaps)
+	}
+	bit := func(data []byte, i int) byte { return data[i/8] >> (i % 8) & 1 }
+
+	// corrupt the middle of the segment between RST2 and RST3
+	img2 := append([]byte(nil), buf.Bytes()...)
+	rst2 := bytes.Index(img2, []byte{0xff, rst0Marker + 2})
+	rst3 := bytes.Index(img2, []byte{0xff, rst0Marker + 3})
+	for i := rst2 + 4; i < rst3-2; i++ {
+		img2[i] = 0
+	}
+	if _, err := Reveal(bytes.NewReader(img2)); err == nil {
+		t.Fatal("Reveal succeeded on corrupt image")
+	}
+	rec, err := RevealTolerant(bytes.NewReader(img2), nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rec.Gaps) != 1 {
+		t.Fatalf("expected 1 gap, got %+v", rec.Gaps)
+	}
+	g := rec.Gaps[0]
+	if g.MCU0 != 3*m.ri || g.MCU1 != 4*m.ri || g.Bits == 0 {
+		t.Fatalf("bad gap %+v", g)
+	}
+	// the bits on either side of the gap should be intact, and only those
+	// within it unreliable
+	tail := rec.Bits - (g.Bit + g.Bits)
+	for i := 0; i < rec.Bits; i++ {
+		unreliable := bit(rec.Unreliable, i) == 1
+		switch {
+		case i < g.Bit:
+			if unreliable || bit(rec.Data, i) != bit(clean.Data, i) {
+				t.Fatalf("bit %v before gap is wrong", i)
+			}
+		case i < g.Bit+g.Bits:
+			if !unreliable {
+				t.Fatalf("bit %v within gap is not marked unreliable", i)
+			}
+		default:
+			if unreliable || bit(rec.Data, i) != bit(clean.Data, clean.Bits-tail+i-(g.Bit+g.Bits)) {
+				t.Fatalf("bit %v after gap is wrong", i)
+			}
+		}
+	}
+}
+
+func TestRevealImage(t *testing.T) {
+	for _, name := range loadTestImages(t) {
+		b, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Reveal(bytes.NewReader(b))
+		if err != nil {
+			continue // e.g. progressive
+		}
+		want, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, revealed, err := RevealImage(bytes.NewReader(b), nil)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		} else if !bytes.Equal(revealed, data) {
+			t.Errorf("%v: revealed data does not match Reveal", name)
+		}
+		if reflect.TypeOf(got) != reflect.TypeOf(want) || got.Bounds() != want.Bounds() {
+			t.Fatalf("%v: expected %T %v, got %T %v", name, want, want.Bounds(), got, got.Bounds())
+		}
+		// jpeg.Decode may use a different IDCT, so allow for rounding
+		bounds := want.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r0, g0, b0, _ := want.At(x, y).RGBA()
+				r1, g1, b1, _ := got.At(x, y).RGBA()
+				for _, d := range [3]int{int(r0>>8) - int(r1>>8), int(g0>>8) - int(g1>>8), int(b0>>8) - int(b1>>8)} {
+					if d < -4 || d > 4 {
+						t.Fatalf("%v: pixel (%v, %v) differs: expected %v, got %v", name, x, y, want.At(x, y), got.At(x, y))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := []Segment{
+		{Marker: 0xe1, Data: []byte("Exif\x00\x00")},
+		{Marker: 0xfe, Data: []byte("a comment")},
+	}
+	tests := []Options{
+		{},
+		{Options: jpeg.Options{Quality: 90}},
+		{Key: []byte("foo")},
+		{Components: AllComponents},
+		{Components: ComponentCb | ComponentCr, Key: []byte("bar")},
+		{Subsampling: Subsampling422},
+		{Subsampling: Subsampling444, Components: AllComponents},
+		{RestartInterval: 7},
+		{Metadata: metadata},
+	}
+	for _, o := range tests {
+		o := o
+		capacity := CapacityWithOptions(img, &o)
+		data := make([]byte, capacity)
+		rand.New(rand.NewSource(0)).Read(data)
+		var buf bytes.Buffer
+		stats, err := HideStats(&buf, img, data, &o)
+		if err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		} else if stats.Usable/8 != capacity {
+			t.Errorf("%+v: usable coefficients (%v) do not match capacity (%v bytes)", o, stats.Usable, capacity)
+		}
+		if err := HideWithOptions(io.Discard, img, append(data, 0), &o); err != ErrTooSmall {
+			t.Errorf("%+v: expected ErrTooSmall, got %v", o, err)
+		}
+		var par bytes.Buffer
+		if err := HideParallel(&par, img, data, &o, 3); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), par.Bytes()) {
+			t.Errorf("%+v: parallel output differs from sequential output", o)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("%+v: %v", o, err)
+		}
+		revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &o)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed[:len(data)], data) {
+			t.Errorf("%+v: revealed data does not match", o)
+		}
+		if len(o.Key) > 0 {
+			if revealed, _ := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Components: o.Components}); bytes.Equal(revealed[:len(data)], data) {
+				t.Errorf("%+v: data revealed without key", o)
+			}
+		}
+		segments, err := ReadMetadata(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(segments, o.Metadata) {
+			t.Errorf("%+v: expected metadata %q, got %q", o, o.Metadata, segments)
+		}
+	}
+
+	if err := HideWithOptions(io.Discard, img, nil, &Options{Metadata: []Segment{{Marker: 0xd8}}}); err == nil {
+		t.Error("expected error for invalid metadata marker")
+	}
+	if o := FromJPEGOptions(&jpeg.Options{Quality: 0}); o.Quality != 1 {
+		t.Errorf("expected quality 1, got %v", o.Quality)
+	}
+	if FromJPEGOptions(nil) != nil {
+		t.Error("expected nil options")
+	}
+}
+
+func TestBitsPerCoefficient(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cover bytes.Buffer
+	if err := Hide(&cover, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	coverDCT, _, err := readDCT(bytes.NewReader(cover.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []Options{
+		{BitsPerCoefficient: 2},
+		{BitsPerCoefficient: 3},
+		{BitsPerCoefficient: 3, Key: []byte("foo"), Components: AllComponents},
+	} {
+		o := o
+		capacity := CapacityWithOptions(img, &o)
+		if one := CapacityWithOptions(img, &Options{Components: o.Components}); capacity < o.BitsPerCoefficient*one {
+			t.Errorf("%+v: capacity %v is less than %v times %v", o, capacity, o.BitsPerCoefficient, one)
+		}
+		data := make([]byte, capacity)
+		rand.New(rand.NewSource(0)).Read(data)
+		var buf bytes.Buffer
+		stats, err := HideStats(&buf, img, data, &o)
+		if err != nil {
+			t.Fatal(err)
+		} else if stats.Usable*o.BitsPerCoefficient/8 != capacity {
+			t.Errorf("%+v: usable coefficients (%v) do not match capacity (%v bytes)", o, stats.Usable, capacity)
+		}
+		revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &o)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed[:len(data)], data) {
+			t.Errorf("%+v: revealed data does not match", o)
+		}
+
+		// the sign and zero structure of the coefficients must be unchanged
+		stegoDCT, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for c := 0; c < coverDCT.nComp; c++ {
+			for i := range coverDCT.blocks[c] {
+				for j, x := range coverDCT.blocks[c][i] {
+					y := stegoDCT.blocks[c][i][j]
+					if (x < 0) != (y < 0) || (x == 0) != (y == 0) || (x < -1 || x > 1) != (y < -1 || y > 1) {
+						t.Fatalf("%+v: coefficient changed from %v to %v", o, x, y)
+					}
+				}
+			}
+		}
+	}
+	if err := HideWithOptions(io.Discard, img, nil, &Options{BitsPerCoefficient: 4}); err == nil {
+		t.Error("expected error for 4 bits per coefficient")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cover bytes.Buffer
+	if err := Hide(&cover, img, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	coverDCT, _, err := readDCT(bytes.NewReader(cover.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkerboard := SelectorFunc(func(comp, zig int, v int32, bx, by int) bool {
+		return (bx+by)%2 == 0 && JSteg.Select(comp, zig, v, bx, by)
+	})
+	selectors := map[string]Selector{
+		"JSteg":        JSteg,
+		"NonZeroAC":    NonZeroAC,
+		"DC":           DC,
+		"MidFrequency": MidFrequency(6, 27),
+		"checkerboard": checkerboard,
+	}
+	for name, sel := range selectors {
+		for _, o := range []Options{
+			{Selector: sel},
+			{Selector: sel, BitsPerCoefficient: 2, Components: AllComponents},
+		} {
+			o := o
+			capacity := CapacityWithOptions(img, &o)
+			if capacity == 0 {
+				t.Fatalf("%v: no capacity", name)
+			}
+			data := make([]byte, capacity)
+			rand.New(rand.NewSource(0)).Read(data)
+			var buf bytes.Buffer
+			if err := HideWithOptions(&buf, img, data, &o); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			var par bytes.Buffer
+			if err := HideParallel(&par, img, data, &o, 3); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf.Bytes(), par.Bytes()) {
+				t.Errorf("%v: parallel output differs from sequential output", name)
+			}
+			revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &o)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(revealed[:len(data)], data) {
+				t.Errorf("%v: revealed data does not match", name)
+			}
+
+			// signs must be unchanged, and so must zeros, except in DC
+			// coefficients
+			stegoDCT, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for c := 0; c < coverDCT.nComp; c++ {
+				for i := range coverDCT.blocks[c] {
+					for j, x := range coverDCT.blocks[c][i] {
+						y := stegoDCT.blocks[c][i][j]
+						if x < 0 && y >= 0 || x > 0 && y <= 0 || j > 0 && x == 0 && y != 0 {
+							t.Fatalf("%v: coefficient changed from %v to %v", name, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if a, b := Capacity(img, nil), CapacityWithOptions(img, &Options{Selector: NonZeroAC}); a >= b {
+		t.Errorf("NonZeroAC capacity (%v) should exceed JSteg capacity (%v)", b, a)
+	}
+}
+
+func TestEmbedder(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, Capacity(img, nil))
+	rand.New(rand.NewSource(0)).Read(data)
+
+	// LSBReplacement should match the built-in embedding exactly
+	var want, got bytes.Buffer
+	if err := HideWithOptions(&want, img, data, &Options{Key: []byte("foo")}); err != nil {
+		t.Fatal(err)
+	}
+	o := &Options{Key: []byte("foo"), Embedder: LSBReplacement{}, Extractor: LSBReplacement{}}
+	if err := HideWithOptions(&got, img, data, o); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Error("LSBReplacement output differs from built-in embedding")
+	}
+	if err := HideWithOptions(io.Discard, img, append(data, 0), o); err != ErrTooSmall {
+		t.Errorf("expected ErrTooSmall, got %v", err)
+	}
+
+	for _, o := range []*Options{
+		o,
+		{Embedder: LSBMatching{Seed: 1}, Extractor: LSBMatching{}},
+		{Embedder: LSBMatching{Seed: 2}, Extractor: LSBMatching{}, Selector: NonZeroAC, Components: AllComponents},
+		{Embedder: LSBMatching{Seed: 3}, Extractor: LSBMatching{}, Selector: DC, Key: []byte("bar")},
+	} {
+		data := make([]byte, CapacityWithOptions(img, o))
+		rand.New(rand.NewSource(0)).Read(data)
+		var buf bytes.Buffer
+		stats, err := HideStats(&buf, img, data, o)
+		if err != nil {
+			t.Fatal(err)
+		} else if stats.Embedded != 8*len(data) || stats.Changed == 0 {
+			t.Errorf("%T: unexpected stats %+v", o.Embedder, stats)
+		}
+		revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), o)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed[:len(data)], data) {
+			t.Errorf("%T: revealed data does not match", o.Embedder)
+		}
+		dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+		dec.Options = o
+		if revealed, err := dec.Reveal(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed[:len(data)], data) {
+			t.Errorf("%T: Decoder revealed data does not match", o.Embedder)
+		}
+	}
+
+	if err := HideWithOptions(io.Discard, img, data, &Options{Embedder: LSBMatching{}, BitsPerCoefficient: 2}); err == nil {
+		t.Error("expected error for BitsPerCoefficient with an Embedder")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAEAD := func(key string) cipher.AEAD {
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aead
+	}
+	aead := AEAD(newAEAD("0123456789abcdef"))
+
+	// the data is compressible, so it should fit despite the overhead
+	data := bytes.Repeat([]byte("foo bar baz quux "), Capacity(img, nil)/17)
+	codecs := []Codec{Flate, aead, CRC, ReedSolomon(32)}
+	var buf bytes.Buffer
+	if err := HideWithOptions(&buf, img, data, &Options{Codecs: codecs}); err != nil {
+		t.Fatal(err)
+	}
+	// parameters of built-in codecs come from the header
+	revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Flate, aead, CRC, ReedSolomon(8)}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(revealed, data) {
+		t.Error("revealed data does not match")
+	}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Flate, CRC, ReedSolomon(32)}}); err == nil {
+		t.Error("expected error revealing encrypted data without its key")
+	}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{aead}}); err == nil {
+		t.Error("expected error revealing data with codecs that were not opted into")
+	}
+	wrongKey := &Options{Codecs: []Codec{Flate, AEAD(newAEAD("fedcba9876543210")), CRC, ReedSolomon(32)}}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), wrongKey); err == nil {
+		t.Error("expected error revealing encrypted data with the wrong key")
+	}
+	// without codecs, the payload is returned as it was hidden
+	if revealed, err := Reveal(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(revealed, []byte(payloadMagic)) {
+		t.Error("payload header was not returned")
+	}
+
+	// plain data that begins with the header magic is not mistaken for it
+	buf.Reset()
+	plain := []byte(payloadMagic + "foo")
+	if err := Hide(&buf, img, plain, nil); err != nil {
+		t.Fatal(err)
+	} else if revealed, err := Reveal(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(revealed, plain) {
+		t.Error("plain data was not returned unchanged")
+	}
+
+	// decompression is bounded by the payload limit
+	bomb, err := encodePayload(make([]byte, 100<<10), []Codec{Flate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := Hide(&buf, img, bomb, nil); err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.Limits.MaxPayload = 1 << 10
+	dec.Options = &Options{Codecs: []Codec{Flate}}
+	if _, err := dec.Reveal(); err != LimitError("payload size") {
+		t.Errorf("expected payload size LimitError, got %v", err)
+	}
+
+	// Reed-Solomon should correct corrupted bytes
+	payload, err := encodePayload(data, []Codec{Flate, CRC, ReedSolomon(16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// magic, codec count, 3 codecs with 1 byte of parameters, and length
+	hdr := len(payloadMagic) + 1 + 3*2 + 1 + 4
+	rng := rand.New(rand.NewSource(0))
+	for i := hdr; i < len(payload); i += 255 {
+		for j := 0; j < 8 && i+j*31 < len(payload); j++ {
+			payload[i+j*31] ^= byte(1 + rng.Intn(255))
+		}
+	}
+	if decoded, err := decodePayload(payload, []Codec{Flate, CRC, ReedSolomon(16)}, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(decoded, data) {
+		t.Error("corrected data does not match")
+	}
+
+	// data without a header is returned unchanged without codecs, and
+	// rejected with them
+	if decoded, err := decodePayload(data, nil, 0); err != nil || !bytes.Equal(decoded, data) {
+		t.Error("unencoded data was modified")
+	} else if _, err := decodePayload(data, []Codec{Flate}, 0); err == nil {
+		t.Error("expected error decoding unencoded data")
+	}
+}
+
+func TestSign(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(0))
+	pub, priv, _ := ed25519.GenerateKey(rng)
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rng)
+
+	data := []byte("foo bar baz quux")
+	var buf bytes.Buffer
+	if err := HideWithOptions(&buf, img, data, &Options{SigningKey: priv, Codecs: []Codec{Flate}}); err != nil {
+		t.Fatal(err)
+	}
+	trusted := &Options{TrustedKeys: []ed25519.PublicKey{otherPub, pub}, Codecs: []Codec{Flate}}
+	revealed, signer, err := RevealSigned(bytes.NewReader(buf.Bytes()), trusted)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(revealed, data) {
+		t.Error("revealed data does not match")
+	} else if !signer.Equal(pub) {
+		t.Error("wrong signer")
+	}
+	if revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), trusted); err != nil || !bytes.Equal(revealed, data) {
+		t.Error("Reveal did not verify signed data:", err)
+	}
+	untrusted := &Options{TrustedKeys: []ed25519.PublicKey{otherPub}}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), untrusted); err != ErrUntrustedSignature {
+		t.Errorf("expected ErrUntrustedSignature, got %v", err)
+	}
+	if revealed, err := Reveal(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(revealed, []byte(signedMagic)) {
+		t.Error("signed payload was not returned without trusted keys")
+	}
+
+	// plain data that begins with the signature magic is not mistaken for it
+	buf.Reset()
+	plain := []byte(signedMagic + "foo")
+	if err := Hide(&buf, img, plain, nil); err != nil {
+		t.Fatal(err)
+	} else if revealed, err := Reveal(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(revealed, plain) {
+		t.Error("plain data was not returned unchanged")
+	}
+
+	// unsigned data is rejected
+	buf.Reset()
+	if err := Hide(&buf, img, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RevealSigned(bytes.NewReader(buf.Bytes()), trusted); err == nil {
+		t.Error("expected error revealing unsigned data")
+	}
+
+	// a signed payload cannot be moved to an image of different dimensions
+	b := img.Bounds()
+	signed, err := signPayload(data, otherPriv, b.Dx()+1, b.Dy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := Hide(&buf, img, signed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), trusted); err == nil || err == ErrUntrustedSignature {
+		t.Errorf("expected dimension mismatch, got %v", err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(0))
+	newIdentity := func() *ecdh.PrivateKey {
+		key, err := ecdh.X25519().GenerateKey(rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	alice, bob, eve := newIdentity(), newIdentity(), newIdentity()
+
+	data := []byte("foo bar baz quux")
+	var buf bytes.Buffer
+	codecs := []Codec{Flate, Recipients(alice.PublicKey(), bob.PublicKey())}
+	if err := HideWithOptions(&buf, img, data, &Options{Codecs: codecs}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*ecdh.PrivateKey{alice, bob} {
+		revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Flate, Recipient(key)}})
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed, data) {
+			t.Error("revealed data does not match")
+		}
+	}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Flate, Recipient(eve)}}); err == nil {
+		t.Error("expected error revealing data encrypted to other recipients")
+	}
+	if _, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Flate}}); err == nil {
+		t.Error("expected error revealing encrypted data without a recipient key")
+	}
+
+	// ed25519 keys convert to matching X25519 keys
+	pub, priv, _ := ed25519.GenerateKey(rng)
+	xpriv, err := X25519PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := X25519PublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	} else if !xpub.Equal(xpriv.PublicKey()) {
+		t.Fatal("converted public key does not match converted private key")
+	}
+	buf.Reset()
+	if err := HideWithOptions(&buf, img, data, &Options{Codecs: []Codec{Recipients(xpub)}}); err != nil {
+		t.Fatal(err)
+	}
+	if revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &Options{Codecs: []Codec{Recipient(xpriv)}}); err != nil || !bytes.Equal(revealed, data) {
+		t.Error("could not reveal data encrypted to converted key:", err)
+	}
+}
+
+func TestCapacityOverhead(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(0))
+	_, priv, _ := ed25519.GenerateKey(rng)
+	identity, err := ecdh.X25519().GenerateKey(rng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(make([]byte, 16))
+	aead, _ := cipher.NewGCM(block)
+
+	// random data of the reported capacity should fit, and no more, except
+	// that Flate usually has some slack
+	for _, o := range []*Options{
+		{SigningKey: priv},
+		{Codecs: []Codec{CRC}},
+		{Codecs: []Codec{AEAD(aead), CRC, ReedSolomon(32)}},
+		{Codecs: []Codec{Recipients(identity.PublicKey(), identity.PublicKey())}, SigningKey: priv},
+		{Codecs: []Codec{Flate, Recipient(identity), ReedSolomon(8)}, BitsPerCoefficient: 2},
+	} {
+		n := CapacityWithOptions(img, o)
+		if n <= 0 || n >= CapacityWithOptions(img, &Options{BitsPerCoefficient: o.BitsPerCoefficient}) {
+			t.Errorf("%+v: implausible capacity %v", o, n)
+			continue
+		}
+		data := make([]byte, n+1)
+		rng.Read(data)
+		if err := HideWithOptions(io.Discard, img, data[:n], o); err != nil {
+			t.Errorf("%+v: could not hide %v bytes: %v", o, n, err)
+		}
+		exact := o.Codecs == nil || o.Codecs[0] != Flate
+		if err := HideWithOptions(io.Discard, img, data, o); exact && err != ErrTooSmall {
+			t.Errorf("%+v: expected ErrTooSmall hiding %v bytes, got %v", o, n+1, err)
+		}
+	}
+
+	// Flate never expands data by more than it accounts for
+	for n := 0; n < 1<<17; n += 997 {
+		m := flateCodec{}.maxInput(n)
+		if m < 0 {
+			continue
+		}
+		data := make([]byte, m)
+		rng.Read(data)
+		if enc, _ := Flate.Encode(data); len(enc) > n {
+			t.Fatalf("encoding %v bytes produced %v, more than %v", m, len(enc), n)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// allow embedding in the left half of the image only
+	b := img.Bounds()
+	half := b.Dx() / 2 &^ 15
+	maskImg := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Min.X+half; x++ {
+			maskImg.Pix[maskImg.PixOffset(x, y)] = 0xff
+		}
+	}
+	mask := ImageMask(maskImg)
+
+	for _, o := range []Options{
+		{},
+		{Components: AllComponents, Subsampling: Subsampling422},
+		{Components: AllComponents, Key: []byte("foo")},
+	} {
+		o := o
+		unmasked := CapacityWithOptions(img, &o)
+		o.Mask = mask
+		capacity := CapacityWithOptions(img, &o)
+		if capacity == 0 || capacity >= unmasked {
+			t.Fatalf("%+v: masked capacity %v, unmasked %v", o, capacity, unmasked)
+		}
+		data := make([]byte, capacity)
+		rand.New(rand.NewSource(0)).Read(data)
+		var cover, buf bytes.Buffer
+		if err := HideWithOptions(&cover, img, nil, &Options{Subsampling: o.Subsampling}); err != nil {
+			t.Fatal(err)
+		} else if err := HideWithOptions(&buf, img, data, &o); err != nil {
+			t.Fatal(err)
+		}
+		revealed, err := RevealWithOptions(bytes.NewReader(buf.Bytes()), &o)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(revealed[:len(data)], data) {
+			t.Errorf("%+v: revealed data does not match", o)
+		}
+
+		// only blocks that lie entirely in the left half may change
+		coverDCT, _, err := readDCT(bytes.NewReader(cover.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stegoDCT, _, err := readDCT(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stegoDCT.forEachBlockAt(func(c, bx, by int, sb *block) {
+			scale := coverDCT.comp[0].h / coverDCT.comp[c].h
+			if cb := coverDCT.blocks[c][by*coverDCT.stride(c)+bx]; *sb != cb && (bx+1)*8*scale > half {
+				t.Fatalf("%+v: masked block (%v, %v) of component %v changed", o, bx, by, c)
+			}
+		})
+	}
+
+	// without the mask, the data cannot be revealed
+	o := &Options{Mask: mask}
+	data := []byte("foo bar baz quux")
+	var buf bytes.Buffer
+	if err := HideWithOptions(&buf, img, data, o); err != nil {
+		t.Fatal(err)
+	}
+	if revealed, err := Reveal(bytes.NewReader(buf.Bytes())); err == nil && bytes.HasPrefix(revealed, data) {
+		t.Error("revealed masked data without the mask")
+	}
+}
+
+func TestRevealVariants(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Options{Key: []byte("foo"), Codecs: []Codec{CRC}}
+	data := []byte("foo bar baz quux")
+	var buf bytes.Buffer
+	if err := HideContext(context.Background(), &buf, img, data, o, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := func() io.Reader { return bytes.NewReader(buf.Bytes()) }
+	variants := map[string]func() ([]byte, error){
+		"RevealWithOptions": func() ([]byte, error) { return RevealWithOptions(r(), o) },
+		"RevealContext": func() ([]byte, error) {
+			return RevealContext(context.Background(), r(), o, nil)
+		},
+		"RevealWithLimits": func() ([]byte, error) {
+			return RevealWithLimits(r(), o, DecodeLimits{MaxPayload: 1 << 10})
+		},
+		"RevealPartial": func() ([]byte, error) { return RevealPartial(r(), o) },
+		"RevealTolerant": func() ([]byte, error) {
+			rec, err := RevealTolerant(r(), o)
+			if err != nil {
+				return nil, err
+			}
+			return rec.Payload, nil
+		},
+		"RevealImage": func() ([]byte, error) {
+			_, revealed, err := RevealImage(r(), o)
+			return revealed, err
+		},
+	}
+	for name, reveal := range variants {
+		if revealed, err := reveal(); err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if !bytes.Equal(revealed, data) {
+			t.Errorf("%v: revealed data does not match", name)
+		}
+	}
+}
+
+func FuzzReveal(f *testing.F) {
+	files, err := filepath.Glob("testdata/*.jpeg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	limits := DecodeLimits{
+		MaxPixels:   1 << 20,
+		MaxPayload:  1 << 12,
+		MaxMarkers:  64,
+		MaxSegments: 1 << 10,
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, workers := range []int{1, 4} {
+			d := decoder{workers: workers, limits: limits}
+			_, err := d.decode(bytes.NewReader(b), false)
+			if len(d.data) > limits.MaxPayload {
+				t.Fatalf("revealed %v bytes, exceeding limit of %v", len(d.data), limits.MaxPayload)
+			} else if d.width*d.height > limits.MaxPixels && err == nil {
+				t.Fatalf("decoded %vx%v image, exceeding limit of %v pixels", d.width, d.height, limits.MaxPixels)
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package jsteg
+
+import "io"
+
+// DecodeLimits bound the resources used to decode an untrusted image. A zero
+// field imposes no limit.
+type DecodeLimits struct {
+	// MaxPixels is the maximum width × height of the image.
+	MaxPixels int
+	// MaxPayload is the maximum number of bytes of hidden data to reveal.
+	MaxPayload int
+	// MaxMarkers is the maximum number of markers, such as SOF, DHT, or APPn,
+	// in the image.
+	MaxMarkers int
+	// MaxSegments is the maximum number of entropy-coded segments, i.e. the
+	// number of scans plus the number of RST markers within them.
+	MaxSegments int
+}
+
+// A LimitError reports that decoding an image would exceed one of its
+// DecodeLimits.
+type LimitError string
+
+func (e LimitError) Error() string { return "jsteg: limit exceeded: " + string(e) }
+
+// RevealWithLimits is like RevealWithOptions, but returns a LimitError if
+// decoding r would exceed any of the limits in l. The limit on the payload
+// also applies to the output of each of the Codecs of o.
+func RevealWithLimits(r io.Reader, o *Options, l DecodeLimits) ([]byte, error) {
+	d := decoder{workers: 1, limits: l}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+	data, _, err := d.reveal(o)
+	return data, err
+}
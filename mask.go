@@ -0,0 +1,76 @@
+package jsteg
+
+import (
+	"image"
+	"image/color"
+)
+
+// A BlockMask reports whether the 8x8 block of component comp (0 for Y, 1 for
+// Cb, and 2 for Cr) that covers the pixels r of an image may carry data. r is
+// relative to the top-left pixel of the image, and is clipped to its bounds;
+// a subsampled chroma block covers more pixels than a luma block. Blocks that
+// lie entirely outside the image never carry data.
+type BlockMask func(comp int, r image.Rectangle) bool
+
+// ImageMask returns a BlockMask that allows the blocks whose pixels are all
+// light in m, i.e. whose gray level is at least half of the maximum. Pixel
+// (x, y) of the image corresponds to m.Bounds().Min.Add(image.Pt(x, y)), and
+// pixels outside m are dark. White marks the regions in which embedding is
+// allowed, such as textured areas, and black those in which it would be
+// visible, such as flat sky or faces.
+func ImageMask(m image.Image) BlockMask {
+	min := m.Bounds().Min
+	return func(comp int, r image.Rectangle) bool {
+		r = r.Add(min)
+		if !r.In(m.Bounds()) {
+			return false
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if color.Gray16Model.Convert(m.At(x, y)).(color.Gray16).Y < 0x8000 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+// maskedSelector selects the coefficients that its Selector selects in the
+// blocks allowed by a BlockMask.
+type maskedSelector struct {
+	Selector
+	// allowed records, for each component, whether each block may carry
+	// data, in rows of stride blocks.
+	allowed [3][]bool
+	stride  [3]int
+}
+
+// Select implements Selector.
+func (s *maskedSelector) Select(comp, zig int, v int32, bx, by int) bool {
+	if comp >= len(s.allowed) || bx >= s.stride[comp] {
+		return false
+	}
+	i := by*s.stride[comp] + bx
+	return i < len(s.allowed[comp]) && s.allowed[comp][i] && s.Selector.Select(comp, zig, v, bx, by)
+}
+
+// newMaskedSelector returns a Selector that restricts sel to the blocks of a
+// width x height image that mask allows. Component c has grid[c] blocks in
+// each dimension, each of which covers 8*scale[c] pixels in that dimension.
+func newMaskedSelector(sel Selector, mask BlockMask, width, height int, grid, scale [3]image.Point) *maskedSelector {
+	s := &maskedSelector{Selector: sel}
+	bounds := image.Rect(0, 0, width, height)
+	for c := range s.allowed {
+		w, h := 8*scale[c].X, 8*scale[c].Y
+		s.stride[c] = grid[c].X
+		s.allowed[c] = make([]bool, grid[c].X*grid[c].Y)
+		for by := 0; by < grid[c].Y; by++ {
+			for bx := 0; bx < grid[c].X; bx++ {
+				r := image.Rect(bx*w, by*h, (bx+1)*w, (by+1)*h).Intersect(bounds)
+				s.allowed[c][by*grid[c].X+bx] = !r.Empty() && mask(c, r)
+			}
+		}
+	}
+	return s
+}
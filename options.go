@@ -0,0 +1,263 @@
+package jsteg
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"io"
+)
+
+// A Mode is an algorithm for hiding data in the coefficients of an image.
+type Mode int
+
+const (
+	// ModeLSB replaces the least significant bit of each coefficient's
+	// magnitude, as JSteg does.
+	ModeLSB Mode = iota
+)
+
+// Components is a set of color components.
+type Components uint8
+
+const (
+	// ComponentY is the luma component.
+	ComponentY Components = 1 << iota
+	// ComponentCb is the blue-difference chroma component.
+	ComponentCb
+	// ComponentCr is the red-difference chroma component.
+	ComponentCr
+
+	// AllComponents is the set of all three components.
+	AllComponents = ComponentY | ComponentCb | ComponentCr
+)
+
+// Subsampling is a chroma subsampling ratio.
+type Subsampling int
+
+const (
+	// Subsampling420 halves the chroma resolution in both dimensions.
+	Subsampling420 Subsampling = iota
+	// Subsampling422 halves the chroma resolution horizontally.
+	Subsampling422
+	// Subsampling444 keeps the chroma at full resolution.
+	Subsampling444
+)
+
+// A Segment is a JPEG marker segment, such as an APPn or COM segment.
+type Segment struct {
+	// Marker is the second byte of the marker, e.g. 0xe1 for APP1.
+	Marker byte
+	// Data is the contents of the segment, excluding its marker and length.
+	Data []byte
+}
+
+// Options are the parameters of HideWithOptions, CapacityWithOptions, and
+// RevealWithOptions, and of their variants, such as HideContext and
+// RevealTolerant; below, Hide and Reveal refer to all of them. A nil *Options
+// is equivalent to a zero Options.
+type Options struct {
+	// Quality ranges from 1 to 100 inclusive, higher is better. A zero
+	// Quality means jpeg.DefaultQuality.
+	jpeg.Options
+	// Mode is the built-in embedding algorithm, used if Embedder is nil.
+	Mode Mode
+	// Embedder, if non-nil, hides the data in the coefficients chosen by
+	// Selector, in place of Mode. The matching Extractor must be passed to
+	// Reveal. With a Key, the Embedder sees the coefficients in the order
+	// derived from it.
+	Embedder Embedder
+	// Extractor, if non-nil, reveals data hidden by an Embedder.
+	Extractor Extractor
+	// Key, if non-empty, scatters the data across the coefficients in a
+	// pseudorandom order derived from it, instead of embedding it from the
+	// top of the image down. The same Key must be passed to Reveal.
+	Key []byte
+	// BitsPerCoefficient is the number of low bits of each eligible
+	// coefficient's magnitude that carry data, from 1 to 3. More bits raise
+	// the capacity of the image, but make the embedding easier to detect.
+	// The zero value means 1. The same BitsPerCoefficient must be passed to
+	// Reveal.
+	BitsPerCoefficient int
+	// Selector selects the coefficients that carry data. The zero value
+	// means JSteg. The same Selector must be passed to Reveal.
+	Selector Selector
+	// Mask, if non-nil, restricts the Selector to the blocks that it allows,
+	// keeping data out of regions where changes would be visible. Capacity
+	// honors it. The same Mask must be passed to Reveal, so it should depend
+	// only on the positions of the blocks, not on their contents, which
+	// embedding changes.
+	Mask BlockMask
+	// Components are the components whose coefficients carry data. The zero
+	// value means ComponentY. Grayscale images only have a Y component. The
+	// same Components must be passed to Reveal.
+	Components Components
+	// Subsampling is the chroma subsampling ratio of color images.
+	Subsampling Subsampling
+	// RestartInterval, if non-zero, is the number of MCUs between RST markers.
+	// It must be less than 65536.
+	RestartInterval int
+	// Codecs, if non-empty, are applied to the data in turn before it is
+	// hidden, e.g. to compress, encrypt, and add error correction to it. They
+	// are recorded in a header, which Reveal reads to undo them, but only
+	// if it is also given Codecs: each Codec in the header must be one of
+	// them, or of the same kind for a built-in Codec. Payloads encoded by
+	// Recipients need the Codec returned by Recipient.
+	Codecs []Codec
+	// SigningKey, if non-nil, signs the data hidden by Hide, along with the
+	// dimensions of the image, so that Reveal can verify its origin. The
+	// signature covers the data after any Codecs are applied.
+	SigningKey ed25519.PrivateKey
+	// TrustedKeys, if non-empty, are the keys Reveal accepts signatures
+	// from. Reveal then rejects data that is not signed by one of them, or
+	// that was signed for an image of different dimensions. If TrustedKeys
+	// is empty, Reveal returns signed data with its signature attached.
+	TrustedKeys []ed25519.PublicKey
+	// Metadata are APPn and COM segments to write after the Start Of Image
+	// marker, such as those returned by ReadMetadata.
+	Metadata []Segment
+}
+
+// FromJPEGOptions adapts o for use with HideWithOptions and
+// CapacityWithOptions. A Quality below 1 is treated as 1, as it is by Hide and
+// Capacity.
+func FromJPEGOptions(o *jpeg.Options) *Options {
+	if o == nil {
+		return nil
+	}
+	q := o.Quality
+	if q < 1 {
+		q = 1
+	}
+	return &Options{Options: jpeg.Options{Quality: q}}
+}
+
+// quality returns the quality of o, clipped to [1, 100].
+func (o *Options) quality() int {
+	quality := o.Quality
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	} else if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	return quality
+}
+
+// components returns the components of o that carry data.
+func (o *Options) components() Components {
+	if o.Components == 0 {
+		return ComponentY
+	}
+	return o.Components
+}
+
+// bitsPerCoefficient returns the number of bits that each eligible coefficient
+// carries.
+func (o *Options) bitsPerCoefficient() int {
+	if o.BitsPerCoefficient == 0 {
+		return 1
+	}
+	return o.BitsPerCoefficient
+}
+
+// validate checks that o describes a supported configuration.
+func (o *Options) validate() error {
+	if o.Mode != ModeLSB {
+		return errors.New("jsteg: unknown mode")
+	}
+	if o.BitsPerCoefficient < 0 || o.BitsPerCoefficient > 3 {
+		return errors.New("jsteg: bits per coefficient out of range")
+	} else if o.BitsPerCoefficient > 1 && (o.Embedder != nil || o.Extractor != nil) {
+		return errors.New("jsteg: bits per coefficient only applies to the built-in embedding")
+	}
+	if o.Components&^AllComponents != 0 {
+		return errors.New("jsteg: unknown component")
+	}
+	if o.Subsampling < Subsampling420 || o.Subsampling > Subsampling444 {
+		return errors.New("jsteg: unknown subsampling ratio")
+	}
+	if o.RestartInterval < 0 || o.RestartInterval >= 1<<16 {
+		return errors.New("jsteg: restart interval out of range")
+	}
+	if o.SigningKey != nil && len(o.SigningKey) != ed25519.PrivateKeySize {
+		return errors.New("jsteg: bad signing key length")
+	}
+	for _, k := range o.TrustedKeys {
+		if len(k) != ed25519.PublicKeySize {
+			return errors.New("jsteg: bad trusted key length")
+		}
+	}
+	for _, s := range o.Metadata {
+		if !(app0Marker <= s.Marker && s.Marker <= app15Marker || s.Marker == comMarker) {
+			return errors.New("jsteg: metadata segment is not an APPn or COM segment")
+		} else if 2+len(s.Data) >= 1<<16 {
+			return errors.New("jsteg: metadata segment is too large")
+		}
+	}
+	return nil
+}
+
+// ReadMetadata reads a JPEG image from r and returns its APPn and COM
+// segments, for use in Options.Metadata. The APP14 (Adobe) segment is
+// omitted, since it describes the color encoding of the image, which Hide
+// chooses itself.
+func ReadMetadata(r io.Reader) ([]Segment, error) {
+	d := decoder{keepMetadata: true}
+	if _, err := d.decode(r, true); err != nil {
+		return nil, err
+	}
+	return d.metadata, nil
+}
+
+// keyedOrder returns the first k elements of a pseudorandom permutation of
+// [0, n), derived from key by a Fisher-Yates shuffle. Since the shuffle fixes
+// one element at a time, the result is a prefix of that for any larger k.
+func keyedOrder(key []byte, n, k int) []int32 {
+	perm := make([]int32, n)
+	for i := range perm {
+		perm[i] = int32(i)
+	}
+	seed := sha256.Sum256(key)
+	var buf [32 + 8]byte
+	copy(buf[:], seed[:])
+	var block [32]byte
+	for i := 0; i < k; i++ {
+		// Each hash yields four 64-bit values, which are reduced modulo the
+		// number of remaining elements. The bias this introduces is
+		// negligible for any practical n.
+		if i%4 == 0 {
+			binary.LittleEndian.PutUint64(buf[32:], uint64(i/4))
+			block = sha256.Sum256(buf[:])
+		}
+		r := binary.LittleEndian.Uint64(block[8*(i%4):])
+		j := i + int(r%uint64(n-i))
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm[:k]
+}
+
+// scatter spreads the bits of data across n positions in the order derived
+// from key. It returns the bits at each position, along with a mask of the
+// positions that were used.
+func scatter(data, key []byte, n int) (bits, mask []byte) {
+	bits = make([]byte, (n+7)/8)
+	mask = make([]byte, (n+7)/8)
+	for k, s := range keyedOrder(key, n, 8*len(data)) {
+		bits[s/8] |= (data[k/8] >> (k % 8) & 1) << (s % 8)
+		mask[s/8] |= 1 << (s % 8)
+	}
+	return bits, mask
+}
+
+// gather is the inverse of scatter: it returns the n bits of bits in the
+// order derived from key.
+func gather(bits, key []byte, n int) []byte {
+	data := make([]byte, (n+7)/8)
+	for k, s := range keyedOrder(key, n, n) {
+		data[k/8] |= (bits[s/8] >> (s % 8) & 1) << (k % 8)
+	}
+	return data
+}
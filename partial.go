@@ -0,0 +1,50 @@
+package jsteg
+
+import (
+	"fmt"
+	"io"
+)
+
+// A PartialError records where RevealPartial stopped decoding an image.
+type PartialError struct {
+	// Offset is the number of bytes of the image consumed before the error
+	// occurred.
+	Offset int64
+	// MCU is the index, within its scan, of the MCU (Minimum Coded Unit) that
+	// was being decoded, or -1 if the error occurred outside of a scan's
+	// entropy-coded data.
+	MCU int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("jsteg: decoding stopped at byte %v (MCU %v): %v", e.Offset, e.MCU, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// RevealPartial is like RevealWithOptions, but is lenient with truncated or
+// corrupt images: if decoding fails, it returns the data extracted up to that
+// point along with a *PartialError. The last byte of that data may be
+// incomplete, in which case its missing high bits are zero. The Key, Codecs,
+// and TrustedKeys of o need all of the data, so they are not applied to it,
+// and it is in the order in which it was extracted. Like RevealWithLimits,
+// RevealPartial decodes sequentially.
+func RevealPartial(r io.Reader, o *Options) ([]byte, error) {
+	d := decoder{workers: 1, mcu: -1}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return d.payload(nil), &PartialError{
+			Offset: d.nRead - int64(d.bytes.j-d.bytes.i),
+			MCU:    d.mcu,
+			Err:    err,
+		}
+	}
+	data, _, err := d.reveal(o)
+	return data, err
+}
@@ -0,0 +1,310 @@
+package jsteg
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A Codec is a reversible transformation of a payload, such as compression or
+// encryption. Given a list of Codecs in Options.Codecs, HideWithOptions
+// applies each in turn to the data and records the list in a header, so that
+// RevealWithOptions can undo them in reverse.
+type Codec interface {
+	// ID identifies the kind of Codec in payload headers. IDs below 128 are
+	// reserved for the built-in Codecs.
+	ID() byte
+	// Params returns the parameters of the Codec that are recorded in payload
+	// headers, at most 255 bytes. Secrets, such as keys, must not be included.
+	Params() []byte
+	// Encode transforms data.
+	Encode(data []byte) ([]byte, error)
+	// Decode undoes Encode.
+	Decode(data []byte) ([]byte, error)
+}
+
+// The IDs of the built-in Codecs.
+const (
+	codecFlate byte = iota + 1
+	codecAEAD
+	codecReedSolomon
+	codecCRC
+	codecRecipients
+)
+
+// Flate is the Codec that compresses payloads with DEFLATE.
+var Flate Codec = flateCodec{}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte       { return codecFlate }
+func (flateCodec) Params() []byte { return nil }
+
+func (flateCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCodec) Decode(data []byte) ([]byte, error) {
+	return c.decodeLimit(data, 0)
+}
+
+// decodeLimit is like Decode, but returns a LimitError if the decompressed
+// payload would exceed max bytes. A max of 0 imposes no limit.
+func (flateCodec) decodeLimit(data []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	} else if len(out) > max {
+		return nil, LimitError("payload size")
+	}
+	return out, nil
+}
+
+// CRC is the Codec that appends a CRC-32 checksum to payloads, and verifies
+// it when they are revealed. It should come before ReedSolomon in a list of
+// Codecs, so that it checks the corrected data.
+var CRC Codec = crcCodec{}
+
+type crcCodec struct{}
+
+func (crcCodec) ID() byte       { return codecCRC }
+func (crcCodec) Params() []byte { return nil }
+
+func (crcCodec) Encode(data []byte) ([]byte, error) {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+	return append(append([]byte(nil), data...), sum[:]...), nil
+}
+
+func (crcCodec) Decode(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("jsteg: payload is too short for its checksum")
+	}
+	data, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.New("jsteg: payload checksum mismatch")
+	}
+	return data, nil
+}
+
+// AEAD returns a Codec that encrypts and authenticates payloads with a, using
+// a random nonce. Since the key is not recorded in the payload header,
+// RevealWithOptions must be passed a Codec returned by AEAD with the same key.
+func AEAD(a cipher.AEAD) Codec { return aeadCodec{a} }
+
+type aeadCodec struct{ a cipher.AEAD }
+
+func (aeadCodec) ID() byte       { return codecAEAD }
+func (aeadCodec) Params() []byte { return nil }
+
+func (c aeadCodec) Encode(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.a.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.a.Seal(nonce, nonce, data, nil), nil
+}
+
+func (c aeadCodec) Decode(data []byte) ([]byte, error) {
+	if len(data) < c.a.NonceSize() {
+		return nil, errors.New("jsteg: payload is too short for its nonce")
+	}
+	nonce, ciphertext := data[:c.a.NonceSize()], data[c.a.NonceSize():]
+	return c.a.Open(nil, nonce, ciphertext, nil)
+}
+
+// ReedSolomon returns a Codec that adds Reed-Solomon error correction to
+// payloads. Each block of up to 255-parity bytes is followed by parity bytes,
+// which allow up to parity/2 corrupted bytes in the block to be corrected.
+// parity must be between 2 and 254.
+func ReedSolomon(parity int) Codec { return rsCodec{parity} }
+
+type rsCodec struct{ parity int }
+
+func (rsCodec) ID() byte         { return codecReedSolomon }
+func (c rsCodec) Params() []byte { return []byte{byte(c.parity)} }
+
+func (c rsCodec) Encode(data []byte) ([]byte, error) {
+	if c.parity < 2 || c.parity > 254 {
+		return nil, errors.New("jsteg: Reed-Solomon parity out of range")
+	}
+	return rsEncode(data, c.parity), nil
+}
+
+func (c rsCodec) Decode(data []byte) ([]byte, error) {
+	if c.parity < 2 || c.parity > 254 {
+		return nil, errors.New("jsteg: Reed-Solomon parity out of range")
+	}
+	return rsDecode(data, c.parity)
+}
+
+// A limitedCodec can stop decoding once its output exceeds a limit, rather
+// than producing all of it first, as a decompressor must to be safe on
+// untrusted payloads.
+type limitedCodec interface {
+	decodeLimit(data []byte, max int) ([]byte, error)
+}
+
+// A sizedCodec knows how much its encoding can expand a payload.
+type sizedCodec interface {
+	// maxInput returns the length of the longest payload whose encoding
+	// fits in n bytes, or a negative number if none does.
+	maxInput(n int) int
+}
+
+// Stored blocks, which Flate falls back to for incompressible data, have a
+// 5-byte header and hold at most flateBlockSize bytes when written by
+// compress/flate; the stream ends with an empty final block.
+const flateBlockSize = 1 << 14
+
+func (flateCodec) maxInput(n int) int {
+	n -= 5
+	return n - 5*((n+flateBlockSize+4)/(flateBlockSize+5))
+}
+
+func (crcCodec) maxInput(n int) int { return n - 4 }
+
+func (c aeadCodec) maxInput(n int) int { return n - c.a.NonceSize() - c.a.Overhead() }
+
+func (c rsCodec) maxInput(n int) int {
+	k := 255 - c.parity
+	return n/255*k + max(n%255-c.parity, 0)
+}
+
+// payloadCapacity returns the length of the longest data that encodePayload
+// can encode with codecs in n bytes. The expansion of Codecs other than the
+// built-in ones is not known, and is not accounted for.
+func payloadCapacity(n int, codecs []Codec) int {
+	n -= len(payloadMagic) + 1 + 4
+	for _, c := range codecs {
+		n -= 2 + len(c.Params())
+	}
+	for i := len(codecs) - 1; i >= 0 && n >= 0; i-- {
+		if sc, ok := codecs[i].(sizedCodec); ok {
+			n = sc.maxInput(n)
+		}
+	}
+	return max(n, 0)
+}
+
+// builtinCodec returns the built-in Codec with the given ID and parameters,
+// or nil if it cannot be constructed from them alone.
+func builtinCodec(id byte, params []byte) Codec {
+	switch {
+	case id == codecFlate && len(params) == 0:
+		return Flate
+	case id == codecCRC && len(params) == 0:
+		return CRC
+	case id == codecReedSolomon && len(params) == 1:
+		return ReedSolomon(int(params[0]))
+	}
+	return nil
+}
+
+// payloadMagic begins the header of a payload encoded by a list of Codecs.
+// The header continues with the number of Codecs and, for each, its ID, the
+// length of its parameters, and the parameters themselves, followed by the
+// length of the encoded payload as a big-endian uint32.
+const payloadMagic = "\x89JSP"
+
+// encodePayload applies codecs to data in turn, and prepends the header.
+func encodePayload(data []byte, codecs []Codec) ([]byte, error) {
+	if len(codecs) > 255 {
+		return nil, errors.New("jsteg: too many codecs")
+	}
+	hdr := append([]byte(payloadMagic), byte(len(codecs)))
+	for _, c := range codecs {
+		params := c.Params()
+		if len(params) > 255 {
+			return nil, fmt.Errorf("jsteg: parameters of codec %v are too long", c.ID())
+		}
+		hdr = append(hdr, c.ID(), byte(len(params)))
+		hdr = append(hdr, params...)
+		var err error
+		if data, err = c.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	if uint64(len(data)) > 1<<32-1 {
+		return nil, ErrTooSmall
+	}
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	hdr = append(hdr, n[:]...)
+	return append(hdr, data...), nil
+}
+
+// decodePayload undoes encodePayload. Each Codec in the header must be one of
+// codecs, or, for a built-in Codec whose parameters differ, of the same kind
+// as one of them; the header alone never causes a Codec to be applied. If
+// max is positive, the output of each Codec is limited to max bytes. If
+// codecs is empty, data is returned unchanged, since it was not encoded.
+func decodePayload(data []byte, codecs []Codec, max int) ([]byte, error) {
+	if len(codecs) == 0 {
+		return data, nil
+	} else if !bytes.HasPrefix(data, []byte(payloadMagic)) {
+		return nil, errors.New("jsteg: payload is not encoded")
+	}
+	errHeader := errors.New("jsteg: malformed payload header")
+	rest := data[len(payloadMagic):]
+	if len(rest) < 1 {
+		return nil, errHeader
+	}
+	stages := make([]Codec, rest[0])
+	rest = rest[1:]
+	for i := range stages {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errHeader
+		}
+		id, params := rest[0], rest[2:2+int(rest[1])]
+		rest = rest[2+len(params):]
+		optedIn := false
+		for _, c := range codecs {
+			if c.ID() == id && bytes.Equal(c.Params(), params) {
+				stages[i] = c
+				break
+			}
+			optedIn = optedIn || c.ID() == id
+		}
+		if stages[i] == nil && optedIn {
+			stages[i] = builtinCodec(id, params)
+		}
+		if stages[i] == nil {
+			return nil, fmt.Errorf("jsteg: payload requires codec %v, which was not provided", id)
+		}
+	}
+	if len(rest) < 4 || uint64(len(rest)-4) < uint64(binary.BigEndian.Uint32(rest)) {
+		return nil, errHeader
+	}
+	data = rest[4 : 4+binary.BigEndian.Uint32(rest)]
+	for i := len(stages) - 1; i >= 0; i-- {
+		var err error
+		if lc, ok := stages[i].(limitedCodec); ok && max > 0 {
+			data, err = lc.decodeLimit(data, max)
+		} else {
+			data, err = stages[i].Decode(data)
+		}
+		if err != nil {
+			return nil, err
+		} else if max > 0 && len(data) > max {
+			return nil, LimitError("payload size")
+		}
+	}
+	return data, nil
+}
@@ -6,9 +6,12 @@
 package jsteg // import "lukechampine.com/jsteg"
 
 import (
+	"context"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"io"
+	"runtime"
 )
 
 var errUnsupportedSubsamplingRatio = jpeg.UnsupportedError("luma/chroma subsampling ratio")
@@ -52,6 +55,13 @@ const (
 	app15Marker = 0xef
 )
 
+// See https://www.sno.phy.queensu.ca/~phil/exiftool/TagNames/JPEG.html#Adobe
+const (
+	adobeTransformUnknown = 0
+	adobeTransformYCbCr   = 1
+	adobeTransformYCbCrK  = 2
+)
+
 // unzig maps from the zig-zag ordering to the natural ordering. For example,
 // unzig[3] is the column and row of the fourth element in zig-zag order. The
 // value is 16, which means first column (16%8 == 0) and third row (16/8 == 2).
@@ -92,6 +102,9 @@ type decoder struct {
 	}
 	width, height int
 
+	// pixels, if set, causes the image to be reconstructed into img1, or
+	// into img3 and blackPix.
+	pixels      bool
 	img1        *image.Gray
 	img3        *image.YCbCr
 	blackPix    []byte
@@ -116,9 +129,53 @@ type decoder struct {
 	quant [maxTq + 1]block // Quantization tables, in zig-zag order.
 	tmp   [2 * blockSize]byte
 
+	// keepCoeffs, if set, causes the quantized DCT coefficients of each block
+	// to be retained in coeffs, in natural (not zig-zag) order.
+	keepCoeffs bool
+	coeffs     [maxComponents][]block
+	// workers, if greater than 1, is the number of goroutines used to decode
+	// scans that have a restart interval.
+	workers int
+	// limits bound the resources used by the decoder. markers and segments
+	// count the markers and entropy-coded segments seen so far.
+	limits            DecodeLimits
+	markers, segments int
+	// ctx, if non-nil, is checked for cancellation after each row of MCUs,
+	// and progress, if non-nil, is called after each row.
+	ctx      context.Context
+	progress func(Progress)
+
+	// nRead is the number of bytes read from r, and mcu is the MCU being
+	// decoded within the current scan, or -1 outside of a scan. They are used
+	// to report where decoding stopped.
+	nRead int64
+	mcu   int
+	// tolerance, if non-nil, causes corrupt entropy-coded segments to be
+	// skipped rather than aborting the decode.
+	tolerance *tolerance
+
+	// keepMetadata, if set, causes the APPn and COM segments other than
+	// APP14 to be retained in metadata instead of being processed.
+	keepMetadata bool
+	metadata     []Segment
+
 	// steganography
 	data    []byte
 	databit uint
+	// comps are the components that carry data, or 0 for just the luma.
+	comps Components
+	// sel selects the coefficients that carry data, or is nil for JSteg.
+	sel Selector
+	// mask, if non-nil, restricts sel to the blocks it allows once the
+	// dimensions of the image are known.
+	mask BlockMask
+	// extractor, if non-nil, reveals the data hidden in values, the
+	// coefficients that carry it, in place of the built-in extraction.
+	extractor Extractor
+	values    []int32
+	// perCoeff is the number of bits each usable coefficient carries, or 0
+	// for 1.
+	perCoeff int
 }
 
 // fill fills up the d.bytes.buf buffer from the underlying io.Reader. It
@@ -137,6 +194,7 @@ func (d *decoder) fill() error {
 	// Fill in the rest of the buffer.
 	n, err := d.r.Read(d.bytes.buf[d.bytes.j:])
 	d.bytes.j += n
+	d.nRead += int64(n)
 	if n > 0 {
 		err = nil
 	}
@@ -174,7 +232,7 @@ func (d *decoder) readByte() (x byte, err error) {
 
 // errMissingFF00 means that readByteStuffedByte encountered an 0xff byte (a
 // marker byte) that wasn't the expected byte-stuffed sequence 0xff, 0x00.
-var errMissingFF00 = jpeg.FormatError("missing 0xff00 sequence")
+var errMissingFF00 error = jpeg.FormatError("missing 0xff00 sequence")
 
 // readByteStuffedByte is like readByte but is for byte-stuffed Huffman data.
 func (d *decoder) readByteStuffedByte() (x byte, err error) {
@@ -298,6 +356,9 @@ func (d *decoder) processSOF(n int) error {
 	}
 	d.height = int(d.tmp[1])<<8 + int(d.tmp[2])
 	d.width = int(d.tmp[3])<<8 + int(d.tmp[4])
+	if d.limits.MaxPixels > 0 && d.width*d.height > d.limits.MaxPixels {
+		return LimitError("pixel count")
+	}
 	if int(d.tmp[5]) != d.nComp {
 		return jpeg.FormatError("SOF has wrong length")
 	}
@@ -395,9 +456,30 @@ func (d *decoder) processSOF(n int) error {
 		d.comp[i].h = h
 		d.comp[i].v = v
 	}
+	if d.mask != nil {
+		d.applyMask()
+	}
 	return nil
 }
 
+// applyMask restricts d's Selector to the blocks allowed by d.mask.
+func (d *decoder) applyMask() {
+	sel := d.sel
+	if sel == nil {
+		sel = JSteg
+	}
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	mxx := (d.width + 8*h0 - 1) / (8 * h0)
+	myy := (d.height + 8*v0 - 1) / (8 * v0)
+	var grid, scale [3]image.Point
+	for i := 0; i < d.nComp && i < len(grid); i++ {
+		h, v := d.comp[i].h, d.comp[i].v
+		grid[i] = image.Pt(mxx*h, myy*v)
+		scale[i] = image.Pt(h0/h, v0/v)
+	}
+	d.sel = newMaskedSelector(sel, d.mask, d.width, d.height, grid, scale)
+}
+
 // Specified in section B.2.4.1.
 func (d *decoder) processDQT(n int) error {
 loop:
@@ -555,6 +637,9 @@ func (d *decoder) decode(r io.Reader, configOnly bool) ([]byte, error) {
 		if marker == eoiMarker { // End Of Image.
 			break
 		}
+		if d.markers++; d.limits.MaxMarkers > 0 && d.markers > d.limits.MaxMarkers {
+			return nil, LimitError("marker count")
+		}
 		if rst0Marker <= marker && marker <= rst7Marker {
 			// Figures B.2 and B.16 of the specification suggest that restart markers should
 			// only occur between Entropy Coded Segments and not after the final ECS.
@@ -575,9 +660,18 @@ func (d *decoder) decode(r io.Reader, configOnly bool) ([]byte, error) {
 			return nil, jpeg.FormatError("short segment length")
 		}
 
+		if d.keepMetadata && (app0Marker <= marker && marker <= app15Marker && marker != app14Marker || marker == comMarker) {
+			data := make([]byte, n)
+			if err := d.readFull(data); err != nil {
+				return nil, err
+			}
+			d.metadata = append(d.metadata, Segment{Marker: marker, Data: data})
+			continue
+		}
+
 		switch marker {
 		case sof0Marker, sof1Marker, sof2Marker:
-			if marker == sof2Marker {
+			if marker == sof2Marker && !d.keepMetadata {
 				return nil, jpeg.UnsupportedError("progressive decoding")
 			}
 			d.baseline = marker == sof0Marker
@@ -602,6 +696,9 @@ func (d *decoder) decode(r io.Reader, configOnly bool) ([]byte, error) {
 				return nil, nil
 			}
 			err = d.processSOS(n)
+			if err == nil {
+				d.mcu = -1
+			}
 		case driMarker:
 			if configOnly {
 				err = d.ignore(n)
@@ -628,12 +725,218 @@ func (d *decoder) decode(r io.Reader, configOnly bool) ([]byte, error) {
 	return d.data, nil
 }
 
+// image returns the image reconstructed by a decoder with pixels set.
+func (d *decoder) image() (image.Image, error) {
+	if d.img1 != nil {
+		return d.img1, nil
+	}
+	if d.img3 != nil {
+		if d.blackPix != nil {
+			return d.applyBlack()
+		} else if d.isRGB() {
+			return d.convertToRGB()
+		}
+		return d.img3, nil
+	}
+	return nil, jpeg.FormatError("missing SOS marker")
+}
+
+// applyBlack combines d.img3 and d.blackPix into a CMYK image. The formula
+// used depends on whether the JPEG image is stored as CMYK or YCbCrK,
+// indicated by the APP14 (Adobe) metadata.
+//
+// Adobe CMYK JPEG images are inverted, where 255 means no ink instead of full
+// ink, so we apply "v = 255 - v" at various points. Note that a double
+// inversion is a no-op, so inversions might be implicit in the code below.
+func (d *decoder) applyBlack() (image.Image, error) {
+	if !d.adobeTransformValid {
+		return nil, jpeg.UnsupportedError("unknown color model: 4-component JPEG doesn't have Adobe APP14 metadata")
+	}
+
+	// If the 4-component JPEG image isn't explicitly marked as "Unknown (RGB
+	// or CMYK)" as per
+	// https://www.sno.phy.queensu.ca/~phil/exiftool/TagNames/JPEG.html#Adobe
+	// we assume that it is YCbCrK. This matches libjpeg's jdapimin.c.
+	if d.adobeTransform != adobeTransformUnknown {
+		// Convert the YCbCr part of the YCbCrK to RGB, invert the RGB to get
+		// CMY, and patch in the original K. The RGB to CMY inversion cancels
+		// out the 'Adobe inversion' described in the applyBlack doc comment
+		// above, so in practice, only the fourth channel (black) is inverted.
+		bounds := d.img3.Bounds()
+		img := image.NewRGBA(bounds)
+		draw.Draw(img, bounds, d.img3, bounds.Min, draw.Src)
+		for iBase, y := 0, bounds.Min.Y; y < bounds.Max.Y; iBase, y = iBase+img.Stride, y+1 {
+			for i, x := iBase+3, bounds.Min.X; x < bounds.Max.X; i, x = i+4, x+1 {
+				img.Pix[i] = 255 - d.blackPix[(y-bounds.Min.Y)*d.blackStride+(x-bounds.Min.X)]
+			}
+		}
+		return &image.CMYK{
+			Pix:    img.Pix,
+			Stride: img.Stride,
+			Rect:   img.Rect,
+		}, nil
+	}
+
+	// The first three channels (cyan, magenta, yellow) of the CMYK
+	// were decoded into d.img3, but each channel was decoded into a separate
+	// []byte slice, and some channels may be subsampled. We interleave the
+	// separate channels into an image.CMYK's single []byte slice containing 4
+	// contiguous bytes per pixel.
+	bounds := d.img3.Bounds()
+	img := image.NewCMYK(bounds)
+
+	translations := [4]struct {
+		src    []byte
+		stride int
+	}{
+		{d.img3.Y, d.img3.YStride},
+		{d.img3.Cb, d.img3.CStride},
+		{d.img3.Cr, d.img3.CStride},
+		{d.blackPix, d.blackStride},
+	}
+	for t, translation := range translations {
+		subsample := d.comp[t].h != d.comp[0].h || d.comp[t].v != d.comp[0].v
+		for iBase, y := 0, bounds.Min.Y; y < bounds.Max.Y; iBase, y = iBase+img.Stride, y+1 {
+			sy := y - bounds.Min.Y
+			if subsample {
+				sy /= 2
+			}
+			for i, x := iBase+t, bounds.Min.X; x < bounds.Max.X; i, x = i+4, x+1 {
+				sx := x - bounds.Min.X
+				if subsample {
+					sx /= 2
+				}
+				img.Pix[i] = 255 - translation.src[sy*translation.stride+sx]
+			}
+		}
+	}
+	return img, nil
+}
+
+func (d *decoder) isRGB() bool {
+	if d.jfif {
+		return false
+	}
+	if d.adobeTransformValid && d.adobeTransform == adobeTransformUnknown {
+		// https://www.sno.phy.queensu.ca/~phil/exiftool/TagNames/JPEG.html#Adobe
+		// says that 0 means Unknown (and in practice RGB) and 1 means YCbCr.
+		return true
+	}
+	return d.comp[0].c == 'R' && d.comp[1].c == 'G' && d.comp[2].c == 'B'
+}
+
+func (d *decoder) convertToRGB() (image.Image, error) {
+	cScale := d.comp[0].h / d.comp[1].h
+	bounds := d.img3.Bounds()
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		po := img.PixOffset(bounds.Min.X, y)
+		yo := d.img3.YOffset(bounds.Min.X, y)
+		co := d.img3.COffset(bounds.Min.X, y)
+		for i, iMax := 0, bounds.Max.X-bounds.Min.X; i < iMax; i++ {
+			img.Pix[po+4*i+0] = d.img3.Y[yo+i]
+			img.Pix[po+4*i+1] = d.img3.Cb[co+i/cScale]
+			img.Pix[po+4*i+2] = d.img3.Cr[co+i/cScale]
+			img.Pix[po+4*i+3] = 255
+		}
+	}
+	return img, nil
+}
+
 // Reveal reads a JPEG image from r and returns the accumulated LSBs of each
-// block.
+// block, as hidden by Hide. Data hidden with other Options can be revealed
+// with RevealWithOptions.
 func Reveal(r io.Reader) ([]byte, error) {
-	var d decoder
+	return RevealWithOptions(r, nil)
+}
+
+// RevealWithOptions is like Reveal, but uses the Key, BitsPerCoefficient,
+// Selector, Mask, Extractor, and Components of o, which must match those
+// passed to HideWithOptions. Default parameters are used if a nil *Options is
+// passed. If o has Codecs, the Codecs recorded in the header written by
+// HideWithOptions are undone, and only the original data is returned. If o
+// has TrustedKeys, the signature of the data is verified. If the image has a
+// restart interval and o has no Extractor, its segments are decoded
+// concurrently.
+//
+// The other variants of Reveal accept an *Options in the same way.
+func RevealWithOptions(r io.Reader, o *Options) ([]byte, error) {
+	d := decoder{workers: runtime.GOMAXPROCS(0)}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, err
+	}
 	if _, err := d.decode(r, false); err != nil {
 		return nil, err
 	}
-	return d.data, nil
+	data, _, err := d.reveal(o)
+	return data, err
+}
+
+// options returns o, or the default Options if o is nil, after checking that
+// it is valid and configuring d according to it.
+func (d *decoder) options(o *Options) (*Options, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	d.setOptions(o)
+	return o, nil
+}
+
+// setOptions configures d according to o, which must be valid.
+func (d *decoder) setOptions(o *Options) {
+	d.comps = o.components()
+	d.sel = o.Selector
+	d.mask = o.Mask
+	d.perCoeff = o.bitsPerCoefficient()
+	if o.Extractor != nil {
+		// The coefficients are collected in order, so they cannot be
+		// decoded concurrently.
+		d.workers = 1
+		d.extractor = o.Extractor
+	}
+}
+
+// payload returns the extracted data, or the data revealed by d's Extractor,
+// undoing the scattering of key if it is non-empty.
+func (d *decoder) payload(key []byte) []byte {
+	if d.extractor != nil {
+		values := d.values
+		if len(key) > 0 {
+			values = make([]int32, len(d.values))
+			for k, i := range keyedOrder(key, len(d.values), len(d.values)) {
+				values[k] = d.values[i]
+			}
+		}
+		return d.extractor.Extract(values)
+	}
+	if len(key) == 0 {
+		return d.data
+	}
+	return gather(d.data, key, d.bitLen())
+}
+
+// RevealImage is like RevealWithOptions, but also returns the decoded image,
+// as jpeg.Decode would, parsing r only once.
+func RevealImage(r io.Reader, o *Options) (image.Image, []byte, error) {
+	d := decoder{workers: runtime.GOMAXPROCS(0), pixels: true}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, nil, err
+	}
+	m, err := d.image()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _, err := d.reveal(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, data, nil
 }
@@ -0,0 +1,192 @@
+package jsteg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+)
+
+// Recipients returns a Codec that encrypts payloads to each of the given
+// X25519 public keys, so that any one of the matching private keys can
+// decrypt them. The payload is encrypted with a random content key, which is
+// wrapped for each recipient with a key derived from an ephemeral ECDH
+// exchange. The number of recipients is visible in the payload, but not
+// their keys. RevealWithOptions must be passed a Codec returned by Recipient.
+func Recipients(keys ...*ecdh.PublicKey) Codec { return recipientCodec{recipients: keys} }
+
+// Recipient returns a Codec that decrypts payloads encrypted by Recipients to
+// the public key of key. As an encoder, it encrypts to that public key alone.
+func Recipient(key *ecdh.PrivateKey) Codec { return recipientCodec{identity: key} }
+
+type recipientCodec struct {
+	recipients []*ecdh.PublicKey
+	identity   *ecdh.PrivateKey
+}
+
+func (recipientCodec) ID() byte       { return codecRecipients }
+func (recipientCodec) Params() []byte { return nil }
+
+// The encoded payload consists of the ephemeral public key, the number of
+// recipients as a byte, the content key wrapped for each recipient, and the
+// nonce and ciphertext of the payload itself.
+const (
+	recipientKeySize     = 32
+	recipientWrappedSize = recipientKeySize + 16
+	recipientNonceSize   = 12
+)
+
+func (c recipientCodec) Encode(data []byte) ([]byte, error) {
+	recipients := c.recipients
+	if c.identity != nil {
+		recipients = []*ecdh.PublicKey{c.identity.PublicKey()}
+	}
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return nil, errors.New("jsteg: number of recipients out of range")
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var contentKey [recipientKeySize]byte
+	if _, err := rand.Read(contentKey[:]); err != nil {
+		return nil, err
+	}
+	out := append(eph.PublicKey().Bytes(), byte(len(recipients)))
+	for _, pub := range recipients {
+		if pub.Curve() != ecdh.X25519() {
+			return nil, errors.New("jsteg: recipient key is not an X25519 key")
+		}
+		shared, err := eph.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		// each wrapping key is used once, so the nonce can be fixed
+		kek := newGCM(wrappingKey(shared, eph.PublicKey(), pub))
+		out = kek.Seal(out, make([]byte, recipientNonceSize), contentKey[:], nil)
+	}
+	nonce := make([]byte, recipientNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return newGCM(contentKey[:]).Seal(out, nonce, data, nil), nil
+}
+
+func (c recipientCodec) maxInput(n int) int {
+	recipients := len(c.recipients)
+	if c.identity != nil {
+		recipients = 1
+	}
+	return n - recipientKeySize - 1 - recipients*recipientWrappedSize - recipientNonceSize - 16
+}
+
+func (c recipientCodec) Decode(data []byte) ([]byte, error) {
+	if c.identity == nil {
+		return nil, errors.New("jsteg: payload is encrypted to a recipient, but no recipient key was given")
+	}
+	errMalformed := errors.New("jsteg: malformed encrypted payload")
+	if len(data) < recipientKeySize+1 {
+		return nil, errMalformed
+	}
+	eph, err := ecdh.X25519().NewPublicKey(data[:recipientKeySize])
+	if err != nil {
+		return nil, errMalformed
+	}
+	n := int(data[recipientKeySize])
+	data = data[recipientKeySize+1:]
+	if len(data) < n*recipientWrappedSize+recipientNonceSize {
+		return nil, errMalformed
+	}
+	shared, err := c.identity.ECDH(eph)
+	if err != nil {
+		return nil, errMalformed
+	}
+	kek := newGCM(wrappingKey(shared, eph, c.identity.PublicKey()))
+	var contentKey []byte
+	for i := 0; i < n && contentKey == nil; i++ {
+		wrapped := data[i*recipientWrappedSize:][:recipientWrappedSize]
+		contentKey, _ = kek.Open(nil, make([]byte, recipientNonceSize), wrapped, nil)
+	}
+	if contentKey == nil {
+		return nil, errors.New("jsteg: payload is not encrypted to this recipient")
+	}
+	data = data[n*recipientWrappedSize:]
+	return newGCM(contentKey).Open(nil, data[:recipientNonceSize], data[recipientNonceSize:], nil)
+}
+
+// wrappingKey derives the key that wraps the content key for the recipient
+// pub from the shared secret of an ECDH exchange with eph, using HKDF-SHA256.
+func wrappingKey(shared []byte, eph, pub *ecdh.PublicKey) []byte {
+	salt := append(eph.Bytes(), pub.Bytes()...)
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(shared)
+	// a single block of output suffices for a 32-byte key
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("jsteg recipient"))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // keys are always 32 bytes
+	}
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// X25519PrivateKey returns the X25519 private key corresponding to an
+// ed25519 private key, so that ed25519 identities can also receive payloads
+// encrypted by Recipients.
+func X25519PrivateKey(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("jsteg: invalid ed25519 private key")
+	}
+	h := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+// curve25519P is the prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519PublicKey returns the X25519 public key corresponding to an ed25519
+// public key, the Montgomery u-coordinate (1 + y) / (1 - y) of the Edwards
+// point.
+func X25519PublicKey(key ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("jsteg: invalid ed25519 public key")
+	}
+	// y is little-endian, with the sign of x in the top bit
+	be := make([]byte, ed25519.PublicKeySize)
+	for i, b := range key {
+		be[len(be)-1-i] = b
+	}
+	be[0] &= 0x7f
+	p := curve25519P
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(p) >= 0 {
+		return nil, errors.New("jsteg: invalid ed25519 public key")
+	}
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, errors.New("jsteg: invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, p))
+	u.Mod(u, p)
+	out := make([]byte, recipientKeySize)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
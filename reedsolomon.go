@@ -0,0 +1,212 @@
+package jsteg
+
+import "errors"
+
+// This file implements a Reed-Solomon code over GF(2^8), with the primitive
+// polynomial x^8 + x^4 + x^3 + x^2 + 1 and the generator roots α^0 through
+// α^(nsym-1). Messages are split into blocks of at most 255-nsym bytes, each
+// of which is followed by nsym parity bytes and can have up to nsym/2 of its
+// bytes corrupted.
+//
+// Codewords are stored with the coefficient of the highest power first, while
+// the polynomials used for decoding store the coefficient of x^i at index i.
+
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfPow returns α^e.
+func gfPow(e int) byte {
+	return gfExp[(e%255+255)%255]
+}
+
+// rsGenerator returns the generator polynomial for nsym parity bytes, highest
+// power first.
+func rsGenerator(nsym int) []byte {
+	g := []byte{1}
+	for i := 0; i < nsym; i++ {
+		// multiply g by (x - α^i)
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfPow(i))
+		}
+		g = next
+	}
+	return g
+}
+
+// rsEncode appends nsym parity bytes to each block of data.
+func rsEncode(data []byte, nsym int) []byte {
+	g := rsGenerator(nsym)
+	k := 255 - nsym
+	out := make([]byte, 0, len(data)+(len(data)+k-1)/k*nsym)
+	for len(data) > 0 {
+		msg := data[:min(k, len(data))]
+		data = data[len(msg):]
+		// The parity bytes are the remainder of msg * x^nsym divided by g.
+		rem := make([]byte, len(msg)+nsym)
+		copy(rem, msg)
+		for i := range msg {
+			if c := rem[i]; c != 0 {
+				for j := 1; j < len(g); j++ {
+					rem[i+j] ^= gfMul(g[j], c)
+				}
+			}
+		}
+		out = append(out, msg...)
+		out = append(out, rem[len(msg):]...)
+	}
+	return out
+}
+
+var errRSUncorrectable = errors.New("jsteg: too many errors to correct")
+
+// rsDecode corrects the blocks of data, which was encoded by rsEncode, and
+// returns them without their parity bytes.
+func rsDecode(data []byte, nsym int) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		if len(data) <= nsym {
+			return nil, errRSUncorrectable
+		}
+		cw := append([]byte(nil), data[:min(255, len(data))]...)
+		data = data[len(cw):]
+		if err := rsCorrect(cw, nsym); err != nil {
+			return nil, err
+		}
+		out = append(out, cw[:len(cw)-nsym]...)
+	}
+	return out, nil
+}
+
+// rsCorrect corrects the errors in the codeword cw in place.
+func rsCorrect(cw []byte, nsym int) error {
+	n := len(cw)
+	synd, clean := rsSyndromes(cw, nsym)
+	if clean {
+		return nil
+	}
+
+	// Find the error locator polynomial with the Berlekamp-Massey algorithm.
+	loc, prev := []byte{1}, []byte{1}
+	l, m, b := 0, 1, byte(1)
+	for i := 0; i < nsym; i++ {
+		d := synd[i]
+		for j := 1; j <= l && j < len(loc); j++ {
+			d ^= gfMul(loc[j], synd[i-j])
+		}
+		if d == 0 {
+			m++
+			continue
+		}
+		next := append([]byte(nil), loc...)
+		for len(next) < len(prev)+m {
+			next = append(next, 0)
+		}
+		coef := gfDiv(d, b)
+		for j, c := range prev {
+			next[j+m] ^= gfMul(coef, c)
+		}
+		if 2*l <= i {
+			l, prev, b, m = i+1-l, loc, d, 1
+		} else {
+			m++
+		}
+		loc = next
+	}
+	if 2*l > nsym {
+		return errRSUncorrectable
+	}
+
+	// Find the roots of the locator, X^-1 for each error locator X = α^e,
+	// where e is the power of the corrupted coefficient.
+	var errPos []int
+	for p := 0; p < n; p++ {
+		xInv := gfPow(-(n - 1 - p))
+		var y byte
+		for j := len(loc) - 1; j >= 0; j-- {
+			y = gfMul(y, xInv) ^ loc[j]
+		}
+		if y == 0 {
+			errPos = append(errPos, p)
+		}
+	}
+	if len(errPos) != l {
+		return errRSUncorrectable
+	}
+
+	// Compute the error magnitudes with Forney's algorithm: the magnitude at
+	// X is X * Ω(X^-1) / Λ'(X^-1), where Ω = S * Λ mod x^nsym.
+	omega := make([]byte, nsym)
+	for i := range omega {
+		for j := 0; j <= i && j < len(loc); j++ {
+			omega[i] ^= gfMul(synd[i-j], loc[j])
+		}
+	}
+	for _, p := range errPos {
+		e := n - 1 - p
+		xInv := gfPow(-e)
+		var num, den byte
+		for j := len(omega) - 1; j >= 0; j-- {
+			num = gfMul(num, xInv) ^ omega[j]
+		}
+		// The formal derivative of Λ keeps only its odd terms.
+		for j := len(loc) - 1; j >= 1; j-- {
+			den = gfMul(den, xInv)
+			if j%2 == 1 {
+				den ^= loc[j]
+			}
+		}
+		if den == 0 {
+			return errRSUncorrectable
+		}
+		cw[p] ^= gfMul(gfPow(e), gfDiv(num, den))
+	}
+	if _, clean := rsSyndromes(cw, nsym); !clean {
+		return errRSUncorrectable
+	}
+	return nil
+}
+
+// rsSyndromes returns the syndromes of cw, the values of cw at each
+// generator root, and whether they are all zero.
+func rsSyndromes(cw []byte, nsym int) ([]byte, bool) {
+	synd := make([]byte, nsym)
+	clean := true
+	for i := range synd {
+		var y byte
+		x := gfPow(i)
+		for _, c := range cw {
+			y = gfMul(y, x) ^ c
+		}
+		synd[i] = y
+		clean = clean && y == 0
+	}
+	return synd, clean
+}
@@ -4,12 +4,63 @@
 
 package jsteg
 
-import "image/jpeg"
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"sync"
+)
 
 const blockSize = 64 // A DCT block is 8x8.
 
 type block [blockSize]int32
 
+// makeImg allocates and initializes the destination image.
+func (d *decoder) makeImg(mxx, myy int) {
+	if d.nComp == 1 {
+		m := image.NewGray(image.Rect(0, 0, 8*mxx, 8*myy))
+		d.img1 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.Gray)
+		return
+	}
+
+	h0 := d.comp[0].h
+	v0 := d.comp[0].v
+	hRatio := h0 / d.comp[1].h
+	vRatio := v0 / d.comp[1].v
+	var subsampleRatio image.YCbCrSubsampleRatio
+	switch hRatio<<4 | vRatio {
+	case 0x11:
+		subsampleRatio = image.YCbCrSubsampleRatio444
+	case 0x12:
+		subsampleRatio = image.YCbCrSubsampleRatio440
+	case 0x21:
+		subsampleRatio = image.YCbCrSubsampleRatio422
+	case 0x22:
+		subsampleRatio = image.YCbCrSubsampleRatio420
+	case 0x41:
+		subsampleRatio = image.YCbCrSubsampleRatio411
+	case 0x42:
+		subsampleRatio = image.YCbCrSubsampleRatio410
+	}
+
+	m := image.NewYCbCr(image.Rect(0, 0, 8*h0*mxx, 8*v0*myy), subsampleRatio)
+	d.img3 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.YCbCr)
+
+	if d.nComp == 4 {
+		h3, v3 := d.comp[3].h, d.comp[3].v
+		d.blackPix = make([]byte, 8*h3*mxx*8*v3*myy)
+		d.blackStride = 8 * h3 * mxx
+	}
+}
+
+// scanComponent describes a component of a scan.
+type scanComponent struct {
+	compIndex uint8
+	td        uint8 // DC table selector.
+	ta        uint8 // AC table selector.
+}
+
 // Specified in section B.2.3.
 func (d *decoder) processSOS(n int) error {
 	if d.nComp == 0 {
@@ -25,11 +76,7 @@ func (d *decoder) processSOS(n int) error {
 	if n != 4+2*nComp {
 		return jpeg.FormatError("SOS length inconsistent with number of components")
 	}
-	var scan [maxComponents]struct {
-		compIndex uint8
-		td        uint8 // DC table selector.
-		ta        uint8 // AC table selector.
-	}
+	var scan [maxComponents]scanComponent
 	totalHV := 0
 	for i := 0; i < nComp; i++ {
 		cs := d.tmp[1+2*i] // Component selector.
@@ -76,83 +123,447 @@ func (d *decoder) processSOS(n int) error {
 	mxx := (d.width + 8*h0 - 1) / (8 * h0)
 	myy := (d.height + 8*v0 - 1) / (8 * v0)
 
+	if d.pixels && d.img1 == nil && d.img3 == nil {
+		d.makeImg(mxx, myy)
+	}
+	if d.keepCoeffs {
+		for i := 0; i < nComp; i++ {
+			compIndex := scan[i].compIndex
+			if d.coeffs[compIndex] == nil {
+				d.coeffs[compIndex] = make([]block, mxx*myy*d.comp[compIndex].h*d.comp[compIndex].v)
+			}
+		}
+	}
+
 	d.bits = bits{}
-	mcu, expectedRST := 0, uint8(rst0Marker)
-	for my := 0; my < myy; my++ {
-		for mx := 0; mx < mxx; mx++ {
-			for i := 0; i < nComp; i++ {
-				compIndex := scan[i].compIndex
-				hi := d.comp[compIndex].h
-				vi := d.comp[compIndex].v
-				for j := 0; j < hi*vi; j++ {
-					// Decode the DC coefficient, as specified in section F.2.2.1.
-					value, err := d.decodeHuffman(&d.huff[dcTable][scan[i].td])
-					if err != nil {
-						return err
-					}
-					if value > 16 {
-						return jpeg.UnsupportedError("excessive DC component")
+	if d.workers > 1 && d.ri > 0 && d.ri < mxx*myy {
+		return d.decodeSegments(scan, nComp, mxx, myy)
+	}
+	if d.tolerance != nil {
+		d.tolerance.startScan(d.bitLen())
+	}
+	expectedRST := uint8(rst0Marker)
+	for mcu := 0; mcu < mxx*myy; {
+		if err := d.addSegment(); err != nil {
+			return err
+		}
+		end := mxx * myy
+		if d.ri > 0 && mcu+d.ri < end {
+			end = mcu + d.ri
+		}
+		start := d.bitLen()
+		err := d.decodeMCUs(scan, nComp, mxx, mcu, end)
+		if err == nil && end < mxx*myy {
+			// Unless the decoder is tolerant of corrupt input, it assumes
+			// well-formed input, and hence that the restart marker follows
+			// immediately.
+			if err = d.readFull(d.tmp[:2]); err == nil && (d.tmp[0] != 0xff || d.tmp[1] != expectedRST) {
+				d.bytes.i -= 2
+				err = jpeg.FormatError("bad RST marker")
+			}
+		}
+		if err != nil {
+			if d.tolerance == nil || d.ri == 0 {
+				return err
+			}
+			if end, err = d.resync(mcu, mxx*myy, start, &expectedRST); err != nil {
+				return err
+			}
+		} else {
+			if d.tolerance != nil {
+				d.tolerance.goodMCUs += end - mcu
+				d.tolerance.goodBits += d.bitLen() - start
+			}
+			expectedRST++
+			if expectedRST == rst7Marker+1 {
+				expectedRST = rst0Marker
+			}
+		}
+		mcu = end
+		if mcu < mxx*myy {
+			// Reset the Huffman decoder.
+			d.bits = bits{}
+		}
+	}
+	if d.tolerance != nil {
+		d.endScan()
+	}
+	return nil
+}
+
+// decodeMCUs decodes the MCUs numbered [mcu0, mcu1) of a scan, which must
+// begin a restart interval.
+func (d *decoder) decodeMCUs(scan [maxComponents]scanComponent, nComp, mxx, mcu0, mcu1 int) error {
+	var (
+		// b is the decoded coefficients, in natural (not zig-zag) order.
+		b block
+		// The DC components are reset at the start of each restart interval,
+		// as per section F.2.1.3.1.
+		dc [maxComponents]int32
+		// bx and by are the location of the current block, in units of 8x8
+		// blocks: the third block in the first row has (bx, by) = (2, 0).
+		bx, by int
+		// carry is the set of components that carry data, sel selects their
+		// coefficients that carry data, and perCoeff is the number of bits
+		// each of those carries.
+		carry    = d.comps
+		perCoeff = d.perCoeff
+		sel      = d.sel
+	)
+	if sel == nil {
+		sel = JSteg
+	}
+	if carry == 0 {
+		carry = ComponentY
+	}
+	if perCoeff == 0 {
+		perCoeff = 1
+	}
+	for mcu := mcu0; mcu < mcu1; mcu++ {
+		d.mcu = mcu
+		mx, my := mcu%mxx, mcu/mxx
+		for i := 0; i < nComp; i++ {
+			compIndex := scan[i].compIndex
+			hi := d.comp[compIndex].h
+			vi := d.comp[compIndex].v
+			for j := 0; j < hi*vi; j++ {
+				// Interleaved scans (those with nComp > 1) are traversed
+				// one MCU at a time, while non-interleaved scans are
+				// traversed left to right, top to bottom, and contain no
+				// data for blocks that lie entirely outside the image.
+				if nComp != 1 {
+					bx = hi*mx + j%hi
+					by = vi*my + j/hi
+				} else {
+					blockCount := mcu*hi*vi + j
+					q := mxx * hi
+					bx = blockCount % q
+					by = blockCount / q
+					if bx*8 >= d.width || by*8 >= d.height {
+						continue
 					}
-					if _, err = d.receiveExtend(value); err != nil {
+				}
+				b = block{}
+
+				// Decode the DC coefficient, as specified in section F.2.2.1.
+				value, err := d.decodeHuffman(&d.huff[dcTable][scan[i].td])
+				if err != nil {
+					return err
+				}
+				if value > 16 {
+					return jpeg.UnsupportedError("excessive DC component")
+				}
+				dcDelta, err := d.receiveExtend(value)
+				if err != nil {
+					return err
+				}
+				dc[compIndex] += dcDelta
+				b[0] = dc[compIndex]
+				if carry&(1<<compIndex) != 0 && sel.Select(int(compIndex), 0, b[0], bx, by) {
+					if err := d.extract(b[0], perCoeff); err != nil {
 						return err
 					}
+				}
 
-					// Decode the AC coefficients, as specified in section F.2.2.2.
-					huff := &d.huff[acTable][scan[i].ta]
-					for zig := 1; zig < blockSize; zig++ {
-						value, err := d.decodeHuffman(huff)
+				// Decode the AC coefficients, as specified in section F.2.2.2.
+				huff := &d.huff[acTable][scan[i].ta]
+				for zig := 1; zig < blockSize; zig++ {
+					value, err := d.decodeHuffman(huff)
+					if err != nil {
+						return err
+					}
+					val0 := value >> 4
+					val1 := value & 0x0f
+					if val1 != 0 {
+						zig += int(val0)
+						if zig >= blockSize {
+							break
+						}
+						ac, err := d.receiveExtend(val1)
 						if err != nil {
 							return err
 						}
-						val0 := value >> 4
-						val1 := value & 0x0f
-						if val1 != 0 {
-							zig += int(val0)
-							if zig > blockSize {
-								break
-							}
-							ac, err := d.receiveExtend(val1)
-							if err != nil {
-								return err
-							}
+						b[unzig[zig]] = ac
 
-							// steganography
-							if i == 0 && (ac < -1 || ac > 1) {
-								if d.databit == 0 {
-									d.data = append(d.data, 0)
-								}
-								d.data[len(d.data)-1] |= byte((ac & 1) << d.databit)
-								d.databit = (d.databit + 1) % 8
+						// steganography
+						if carry&(1<<compIndex) != 0 && sel.Select(int(compIndex), zig, ac, bx, by) {
+							if err := d.extract(ac, perCoeff); err != nil {
+								return err
 							}
+						}
 
-						} else {
-							if val0 != 0x0f {
-								break
-							}
-							zig += 0x0f
+					} else {
+						if val0 != 0x0f {
+							break
 						}
+						zig += 0x0f
+					}
+				}
+
+				if d.keepCoeffs {
+					d.coeffs[compIndex][by*mxx*hi+bx] = b
+				}
+				if d.pixels {
+					if err := d.reconstructBlock(&b, bx, by, int(compIndex)); err != nil {
+						return err
 					}
-				} // for j
-			} // for i
-			mcu++
-			if d.ri > 0 && mcu%d.ri == 0 && mcu < mxx*myy {
-				// A more sophisticated decoder could use RST[0-7] markers to resynchronize from corrupt input,
-				// but this one assumes well-formed input, and hence the restart marker follows immediately.
-				if err := d.readFull(d.tmp[:2]); err != nil {
-					return err
 				}
-				if d.tmp[0] != 0xff || d.tmp[1] != expectedRST {
-					return jpeg.FormatError("bad RST marker")
+			} // for j
+		} // for i
+		if (mcu+1)%mxx == 0 {
+			if err := d.endRow((mcu + 1) / mxx); err != nil {
+				return err
+			}
+		}
+	} // for mcu
+	d.mcu = mcu1
+	return nil
+}
+
+// reconstructBlock dequantizes, performs the inverse DCT and stores the block
+// to the image.
+func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
+	qt := &d.quant[d.comp[compIndex].tq]
+	for zig := 0; zig < blockSize; zig++ {
+		b[unzig[zig]] *= qt[zig]
+	}
+	idct(b)
+	dst, stride := []byte(nil), 0
+	if d.nComp == 1 {
+		dst, stride = d.img1.Pix[8*(by*d.img1.Stride+bx):], d.img1.Stride
+	} else {
+		switch compIndex {
+		case 0:
+			dst, stride = d.img3.Y[8*(by*d.img3.YStride+bx):], d.img3.YStride
+		case 1:
+			dst, stride = d.img3.Cb[8*(by*d.img3.CStride+bx):], d.img3.CStride
+		case 2:
+			dst, stride = d.img3.Cr[8*(by*d.img3.CStride+bx):], d.img3.CStride
+		case 3:
+			dst, stride = d.blackPix[8*(by*d.blackStride+bx):], d.blackStride
+		default:
+			return jpeg.UnsupportedError("too many components")
+		}
+	}
+	// Level shift by +128, clip to [0, 255], and write to dst.
+	for y := 0; y < 8; y++ {
+		y8 := y * 8
+		yStride := y * stride
+		for x := 0; x < 8; x++ {
+			c := b[y8+x]
+			if c < -128 {
+				c = 0
+			} else if c > 127 {
+				c = 255
+			} else {
+				c += 128
+			}
+			dst[yStride+x] = uint8(c)
+		}
+	}
+	return nil
+}
+
+// endRow is called after the given number of rows of MCUs of a scan have been
+// decoded. It reports the decoder's progress, and returns an error if its
+// context is done.
+func (d *decoder) endRow(rows int) error {
+	if d.progress != nil {
+		v0 := d.comp[0].v
+		d.progress(Progress{Rows: rows, TotalRows: (d.height + 8*v0 - 1) / (8 * v0), Bits: d.bitLen()})
+	}
+	if d.ctx != nil {
+		return d.ctx.Err()
+	}
+	return nil
+}
+
+// decodeSegments decodes the remainder of a scan that has a restart interval.
+// The entropy-coded data is read into memory and split at its RST markers,
+// and the resulting segments are decoded concurrently by d.workers
+// goroutines. The extracted bits are then concatenated in order, so the
+// result is identical to that of decoding the segments sequentially.
+func (d *decoder) decodeSegments(scan [maxComponents]scanComponent, nComp, mxx, myy int) error {
+	// Read the data up to the next marker that is not an RST marker,
+	// recording where each segment starts.
+	var data []byte
+	starts := []int{0}
+	expectedRST := uint8(rst0Marker)
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c != 0xff {
+			data = append(data, c)
+			continue
+		}
+		// Skip any fill bytes.
+		for c == 0xff {
+			if c, err = d.readByte(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+		if c == 0x00 {
+			data = append(data, 0xff, 0x00)
+			continue
+		} else if c < rst0Marker || c > rst7Marker {
+			// This marker ends the scan, so give it back.
+			d.bytes.i -= 2
+			break
+		}
+		if c != expectedRST {
+			return jpeg.FormatError("bad RST marker")
+		}
+		expectedRST++
+		if expectedRST == rst7Marker+1 {
+			expectedRST = rst0Marker
+		}
+		if err := d.addSegment(); err != nil {
+			return err
+		}
+		starts = append(starts, len(data))
+	}
+	if err := d.addSegment(); err != nil {
+		return err
+	}
+	nMCU := mxx * myy
+	nSegments := (nMCU + d.ri - 1) / d.ri
+	if len(starts) != nSegments {
+		return jpeg.FormatError("bad RST marker")
+	}
+	starts = append(starts, len(data))
+
+	type result struct {
+		data  []byte
+		nBits int
+		err   error
+	}
+	results := make([]result, nSegments)
+	jobs := make(chan int)
+	go func() {
+		for i := range results {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < d.workers && w < nSegments; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := &decoder{
+				width:      d.width,
+				height:     d.height,
+				comp:       d.comp,
+				huff:       d.huff,
+				limits:     d.limits,
+				comps:      d.comps,
+				sel:        d.sel,
+				perCoeff:   d.perCoeff,
+				keepCoeffs: d.keepCoeffs,
+				coeffs:     d.coeffs,
+				// Segments cover disjoint blocks, so they can share the
+				// destination image.
+				nComp:       d.nComp,
+				quant:       d.quant,
+				pixels:      d.pixels,
+				img1:        d.img1,
+				img3:        d.img3,
+				blackPix:    d.blackPix,
+				blackStride: d.blackStride,
+			}
+			for i := range jobs {
+				sub.r = bytes.NewReader(data[starts[i]:starts[i+1]])
+				sub.bytes.i, sub.bytes.j, sub.bytes.nUnreadable = 0, 0, 0
+				sub.bits = bits{}
+				sub.data, sub.databit = nil, 0
+				end := (i + 1) * d.ri
+				if end > nMCU {
+					end = nMCU
 				}
-				expectedRST++
-				if expectedRST == rst7Marker+1 {
-					expectedRST = rst0Marker
+				err := sub.decodeMCUs(scan, nComp, mxx, i*d.ri, end)
+				nBits := 8 * len(sub.data)
+				if sub.databit != 0 {
+					nBits -= 8 - int(sub.databit)
 				}
-				// Reset the Huffman decoder.
-				d.bits = bits{}
+				results[i] = result{sub.data, nBits, err}
 			}
-		} // for mx
-	} // for my
+		}()
+	}
+	wg.Wait()
 
+	for _, r := range results {
+		if r.err != nil {
+			return r.err
+		}
+		if d.limits.MaxPayload > 0 {
+			nBits := 8*len(d.data) + r.nBits
+			if d.databit != 0 {
+				nBits -= 8 - int(d.databit)
+			}
+			if (nBits+7)/8 > d.limits.MaxPayload {
+				return LimitError("payload size")
+			}
+		}
+		if d.databit == 0 {
+			d.data = append(d.data, r.data...)
+			d.databit = uint(r.nBits % 8)
+			continue
+		}
+		for i := 0; i < r.nBits; i++ {
+			if d.databit == 0 {
+				d.data = append(d.data, 0)
+			}
+			d.data[len(d.data)-1] |= (r.data[i/8] >> (i % 8) & 1) << d.databit
+			d.databit = (d.databit + 1) % 8
+		}
+	}
+	return nil
+}
+
+// extract appends the low n bits of the magnitude of v to the extracted data,
+// or v itself to d.values if the data is revealed by an Extractor.
+func (d *decoder) extract(v int32, n int) error {
+	if d.extractor != nil {
+		d.values = append(d.values, v)
+		return nil
+	}
+	if v < 0 {
+		v = -v
+	}
+	for j := 0; j < n; j++ {
+		if d.databit == 0 {
+			if d.limits.MaxPayload > 0 && len(d.data) >= d.limits.MaxPayload {
+				return LimitError("payload size")
+			}
+			d.data = append(d.data, 0)
+		}
+		d.data[len(d.data)-1] |= byte((v >> j & 1) << d.databit)
+		d.databit = (d.databit + 1) % 8
+	}
+	return nil
+}
+
+// bitLen returns the number of payload bits extracted so far.
+func (d *decoder) bitLen() int {
+	n := 8 * len(d.data)
+	if d.databit != 0 {
+		n -= 8 - int(d.databit)
+	}
+	return n
+}
+
+// addSegment records the start of an entropy-coded segment.
+func (d *decoder) addSegment() error {
+	if d.segments++; d.limits.MaxSegments > 0 && d.segments > d.limits.MaxSegments {
+		return LimitError("segment count")
+	}
 	return nil
 }
@@ -0,0 +1,96 @@
+package jsteg
+
+// A Selector decides which quantized DCT coefficients of an image carry data.
+// HideWithOptions, CapacityWithOptions, and RevealWithOptions consult the
+// same Selector, which must therefore be passed to each of them.
+//
+// Embedding replaces the low bits of the magnitude of each selected
+// coefficient, keeping its sign. Since the coefficient must still be selected
+// when the data is revealed, Hide moves it to the nearest value with the
+// desired low bits that the Selector also selects, never turning a non-zero
+// coefficient into zero. A Selector must therefore select at least one such
+// value for every coefficient that it selects; the built-in Selectors all do.
+type Selector interface {
+	// Select reports whether a coefficient carries data. comp is the
+	// component of its block (0 for Y, 1 for Cb, and 2 for Cr), and bx and
+	// by are the position of the block within that component, in blocks.
+	// zig is the index of the coefficient within the block in zig-zag order,
+	// 0 being the DC coefficient, and v is its quantized value. Zero AC
+	// coefficients are never selected, and Select is not called for them.
+	Select(comp, zig int, v int32, bx, by int) bool
+}
+
+// SelectorFunc adapts an ordinary function to a Selector.
+type SelectorFunc func(comp, zig int, v int32, bx, by int) bool
+
+// Select returns f(comp, zig, v, bx, by).
+func (f SelectorFunc) Select(comp, zig int, v int32, bx, by int) bool {
+	return f(comp, zig, v, bx, by)
+}
+
+var (
+	// JSteg selects the AC coefficients whose magnitude is greater than 1, as
+	// JSteg does. It is the default Selector.
+	JSteg Selector = SelectorFunc(func(comp, zig int, v int32, bx, by int) bool {
+		return zig > 0 && (v < -1 || v > 1)
+	})
+
+	// NonZeroAC selects every non-zero AC coefficient, including those of
+	// magnitude 1, which JSteg avoids. A coefficient of magnitude 1 whose low
+	// bit must be cleared becomes 2, not 0.
+	NonZeroAC Selector = SelectorFunc(func(comp, zig int, v int32, bx, by int) bool {
+		return zig > 0
+	})
+
+	// DC selects the DC coefficient of every block.
+	DC Selector = SelectorFunc(func(comp, zig int, v int32, bx, by int) bool {
+		return zig == 0
+	})
+)
+
+// MidFrequency returns a Selector that selects the AC coefficients whose
+// magnitude is greater than 1, like JSteg, and whose zig-zag index lies
+// between lo and hi inclusive. Changes to mid-frequency coefficients are less
+// visible than changes to low frequencies, and survive recompression better
+// than changes to high frequencies.
+func MidFrequency(lo, hi int) Selector {
+	return SelectorFunc(func(comp, zig int, v int32, bx, by int) bool {
+		return lo <= zig && zig <= hi && zig > 0 && (v < -1 || v > 1)
+	})
+}
+
+// nearestSelected returns the value closest to v, with the same sign, whose
+// magnitude has the same low n bits as want and that s selects, or false if
+// there is no such value nearby. want is the magnitude of v with those bits
+// replaced. If v is non-zero, the result is non-zero as well.
+func nearestSelected(s Selector, comp, zig int, v, want int32, n, bx, by int) (int32, bool) {
+	sign := int32(1)
+	if v < 0 {
+		sign = -1
+	}
+	var best int32
+	found := false
+	// Try want, then the magnitudes 1<<n below and above it, and so on.
+	for d := 0; d < 32; d++ {
+		for _, mag := range [2]int32{want - int32(d)<<n, want + int32(d)<<n} {
+			if mag < 0 || (mag == 0 && v != 0) {
+				continue
+			}
+			c := sign * mag
+			if (!found || abs32(c-v) < abs32(best-v)) && s.Select(comp, zig, c, bx, by) {
+				best, found = c, true
+			}
+		}
+		if found && int32(d)<<n > abs32(best-v) {
+			break
+		}
+	}
+	return best, found
+}
+
+func abs32(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
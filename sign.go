@@ -0,0 +1,103 @@
+package jsteg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+)
+
+// signedMagic begins a signed payload. It is followed by the width and height
+// of the image as big-endian uint16s, the length of the payload as a
+// big-endian uint32, the payload itself, and an ed25519 signature of all that
+// precedes it.
+const signedMagic = "\x89JSS"
+
+const signedHeaderSize = len(signedMagic) + 2 + 2 + 4
+
+// signPayload wraps data in a signed payload for an image with the given
+// dimensions.
+func signPayload(data []byte, key ed25519.PrivateKey, width, height int) ([]byte, error) {
+	if uint64(len(data)) > 1<<32-1 {
+		return nil, ErrTooSmall
+	}
+	msg := make([]byte, signedHeaderSize, signedHeaderSize+len(data)+ed25519.SignatureSize)
+	copy(msg, signedMagic)
+	binary.BigEndian.PutUint16(msg[4:], uint16(width))
+	binary.BigEndian.PutUint16(msg[6:], uint16(height))
+	binary.BigEndian.PutUint32(msg[8:], uint32(len(data)))
+	msg = append(msg, data...)
+	return append(msg, ed25519.Sign(key, msg)...), nil
+}
+
+// ErrUntrustedSignature is returned by RevealWithOptions if the payload is not
+// signed by any of Options.TrustedKeys, or its signature is invalid.
+var ErrUntrustedSignature = errors.New("jsteg: payload is not signed by a trusted key")
+
+// verifyPayload checks that data is a signed payload for an image with the
+// given dimensions, signed by one of trusted, and returns the payload along
+// with the key that signed it. If trusted is empty, data is returned
+// unchanged, since it was not signed.
+func verifyPayload(data []byte, trusted []ed25519.PublicKey, width, height int) ([]byte, ed25519.PublicKey, error) {
+	if len(trusted) == 0 {
+		return data, nil, nil
+	} else if !bytes.HasPrefix(data, []byte(signedMagic)) {
+		return nil, nil, errors.New("jsteg: payload is not signed")
+	}
+	if len(data) < signedHeaderSize {
+		return nil, nil, errors.New("jsteg: malformed signed payload")
+	}
+	n := binary.BigEndian.Uint32(data[8:])
+	if uint64(len(data)-signedHeaderSize) < uint64(n)+ed25519.SignatureSize {
+		return nil, nil, errors.New("jsteg: malformed signed payload")
+	}
+	msg := data[:signedHeaderSize+int(n)]
+	sig := data[len(msg) : len(msg)+ed25519.SignatureSize]
+	for _, key := range trusted {
+		if ed25519.Verify(key, msg, sig) {
+			if int(binary.BigEndian.Uint16(data[4:])) != width || int(binary.BigEndian.Uint16(data[6:])) != height {
+				return nil, nil, errors.New("jsteg: payload was signed for an image of different dimensions")
+			}
+			return msg[signedHeaderSize:], key, nil
+		}
+	}
+	return nil, nil, ErrUntrustedSignature
+}
+
+// RevealSigned is like RevealWithOptions, but also returns the key, from among
+// o.TrustedKeys, that signed the data. o must have at least one trusted key.
+func RevealSigned(r io.Reader, o *Options) ([]byte, ed25519.PublicKey, error) {
+	if o == nil || len(o.TrustedKeys) == 0 {
+		return nil, nil, errors.New("jsteg: no trusted keys were given")
+	} else if err := o.validate(); err != nil {
+		return nil, nil, err
+	}
+	d := decoder{workers: runtime.GOMAXPROCS(0)}
+	d.setOptions(o)
+	if _, err := d.decode(r, false); err != nil {
+		return nil, nil, err
+	}
+	return d.reveal(o)
+}
+
+// reveal returns the data extracted by d, undoing the Key, TrustedKeys, and
+// Codecs of o, along with the key that signed it, if any.
+func (d *decoder) reveal(o *Options) ([]byte, ed25519.PublicKey, error) {
+	return d.unwrap(d.payload(o.Key), o)
+}
+
+// unwrap undoes the TrustedKeys and Codecs of o on data, which was extracted
+// by d, returning the key that signed it, if any.
+func (d *decoder) unwrap(data []byte, o *Options) ([]byte, ed25519.PublicKey, error) {
+	data, signer, err := verifyPayload(data, o.TrustedKeys, d.width, d.height)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = decodePayload(data, o.Codecs, d.limits.MaxPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, signer, nil
+}
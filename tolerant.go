@@ -0,0 +1,197 @@
+package jsteg
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// A Gap is a run of MCUs (Minimum Coded Units) that RevealTolerant could not
+// decode.
+type Gap struct {
+	// MCU0 and MCU1 are the first MCU lost and the first MCU after the gap,
+	// within their scan.
+	MCU0, MCU1 int
+	// Bit is the offset, in bits, of the gap within the revealed data, and
+	// Bits is the number of bits that stand in for those hidden in the lost
+	// MCUs. As that number cannot be known, it is estimated from the number
+	// of bits hidden in the rest of the scan.
+	Bit, Bits int
+}
+
+// A Recovery is the result of RevealTolerant.
+type Recovery struct {
+	// Data is the revealed data, with the Key of the Options undone. Bits is
+	// the number of bits in it, the last byte of Data being padded with
+	// zeros.
+	Data []byte
+	Bits int
+	// Unreliable is a bitmap the same length as Data, in which each bit is
+	// set if the corresponding bit of Data lies within a gap. Bits are
+	// numbered from least to most significant, as in Data.
+	Unreliable []byte
+	// Gaps lists the runs of MCUs that could not be decoded, in order. The
+	// offsets of the gaps are in the order in which the bits were extracted,
+	// before the Key was undone.
+	Gaps []Gap
+	// Payload is Data with the Codecs and TrustedKeys of the Options undone,
+	// as RevealWithOptions would return it, or Data itself if the Options
+	// have neither. It is nil if undoing them failed.
+	Payload []byte
+}
+
+// RevealTolerant is like Reveal, but is tolerant of corrupt entropy-coded
+// data in images that have restart intervals. When a segment between two
+// RST markers cannot be decoded, it is skipped, and the bits it would have
+// held are replaced with zeros and marked as unreliable, so that an
+// error-correcting code can still recover the hidden message. Corrupt data
+// in an image without restart intervals, and errors outside of the
+// entropy-coded data, are returned as usual. Like RevealWithLimits, it
+// decodes sequentially.
+//
+// The Key of o is undone using the estimated sizes of the gaps, so with a
+// Key, the data can only be recovered if they are exact. If the Codecs or
+// TrustedKeys of o cannot be undone, the Recovery is returned along with the
+// error. o may not have an Extractor.
+func RevealTolerant(r io.Reader, o *Options) (*Recovery, error) {
+	if o != nil && o.Extractor != nil {
+		return nil, errors.New("jsteg: RevealTolerant does not support Extractors")
+	}
+	d := decoder{workers: 1, tolerance: new(tolerance)}
+	o, err := d.options(o)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+	rec := &Recovery{
+		Data:       d.data,
+		Bits:       d.bitLen(),
+		Unreliable: make([]byte, len(d.data)),
+		Gaps:       d.tolerance.gaps,
+	}
+	for _, g := range rec.Gaps {
+		for i := g.Bit; i < g.Bit+g.Bits; i++ {
+			rec.Unreliable[i/8] |= 1 << (i % 8)
+		}
+	}
+	if len(o.Key) > 0 {
+		rec.Data = gather(rec.Data, o.Key, rec.Bits)
+		rec.Unreliable = gather(rec.Unreliable, o.Key, rec.Bits)
+	}
+	if rec.Payload, _, err = d.unwrap(rec.Data, o); err != nil {
+		return rec, err
+	}
+	return rec, nil
+}
+
+// tolerance records the gaps in the current scan, along with the number of
+// MCUs decoded successfully and the number of bits extracted from them.
+type tolerance struct {
+	gaps      []Gap
+	scanStart int // index of the first gap in the current scan
+	scanBit   int // offset of the current scan's first bit
+	goodMCUs  int
+	goodBits  int
+}
+
+func (t *tolerance) startScan(bit int) {
+	t.scanStart = len(t.gaps)
+	t.scanBit = bit
+	t.goodMCUs, t.goodBits = 0, 0
+}
+
+// resync recovers from a corrupt entropy-coded segment, which started at MCU
+// mcu and payload bit start, by discarding the bits extracted from it and
+// skipping to the next marker. If that is an RST marker, decoding resumes at
+// the start of the segment that follows it, and expectedRST is updated.
+// Otherwise, the rest of the scan is lost and the marker is left to be read.
+// It returns the MCU at which to resume.
+func (d *decoder) resync(mcu, nMCU, start int, expectedRST *uint8) (int, error) {
+	d.truncateBits(start)
+	d.bits = bits{}
+	d.bytes.i -= d.bytes.nUnreadable
+	d.bytes.nUnreadable = 0
+
+	var marker byte
+	for marker == 0 {
+		c, err := d.readByte()
+		for err == nil && c == 0xff {
+			// Skip any fill bytes, then see whether this is a marker or a
+			// byte-stuffed 0xff.
+			if c, err = d.readByte(); err == nil && c != 0xff {
+				marker = c
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+
+	next := nMCU
+	if rst0Marker <= marker && marker <= rst7Marker {
+		skipped := int(marker-*expectedRST) & 7
+		next = (mcu/d.ri + 1 + skipped) * d.ri
+		*expectedRST = rst0Marker + (marker-rst0Marker+1)&7
+		if next > nMCU {
+			next = nMCU
+		}
+	} else {
+		d.bytes.i -= 2
+	}
+	// The gap's bits are spliced in by endScan.
+	d.tolerance.gaps = append(d.tolerance.gaps, Gap{MCU0: mcu, MCU1: next, Bit: start})
+	return next, nil
+}
+
+// endScan splices the gaps of the current scan into the extracted data,
+// estimating the number of bits each one held from the rest of the scan.
+func (d *decoder) endScan() {
+	t := d.tolerance
+	gaps := t.gaps[t.scanStart:]
+	if len(gaps) == 0 {
+		return
+	}
+	old, oldBits := append([]byte(nil), d.data...), d.bitLen()
+	oldBit := func(i int) byte { return old[i/8] >> (i % 8) & 1 }
+	d.truncateBits(t.scanBit)
+	pos := t.scanBit
+	for i := range gaps {
+		g := &gaps[i]
+		for ; pos < g.Bit; pos++ {
+			d.appendBit(oldBit(pos))
+		}
+		g.Bit = d.bitLen()
+		if t.goodMCUs > 0 {
+			g.Bits = int(math.Round(float64(t.goodBits) * float64(g.MCU1-g.MCU0) / float64(t.goodMCUs)))
+		}
+		for j := 0; j < g.Bits; j++ {
+			d.appendBit(0)
+		}
+	}
+	for ; pos < oldBits; pos++ {
+		d.appendBit(oldBit(pos))
+	}
+}
+
+// appendBit appends a bit to the extracted data.
+func (d *decoder) appendBit(b byte) {
+	if d.databit == 0 {
+		d.data = append(d.data, 0)
+	}
+	d.data[len(d.data)-1] |= b << d.databit
+	d.databit = (d.databit + 1) % 8
+}
+
+// truncateBits discards all but the first n bits of the extracted data.
+func (d *decoder) truncateBits(n int) {
+	d.data = d.data[:(n+7)/8]
+	d.databit = uint(n % 8)
+	if d.databit != 0 {
+		d.data[len(d.data)-1] &= 1<<d.databit - 1
+	}
+}
@@ -0,0 +1,230 @@
+package jsteg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+)
+
+// Op is a lossless transformation of a JPEG image, performed directly on its
+// DCT coefficients in the manner of jpegtran.
+//
+// Each Op is described below in terms of how it moves a block and a
+// coefficient. A block at (bx, by) is moved within a grid of W×H blocks
+// (measured after the transformation), and the coefficient at horizontal
+// frequency u and vertical frequency v, i.e. natural index 8*v+u, is moved
+// within the block. Mirroring a block negates the coefficients with an odd
+// frequency along the mirrored axis.
+type Op int
+
+const (
+	// Identity leaves the image unchanged. It is useful in conjunction with
+	// TransformOptions.Crop.
+	Identity Op = iota
+	// FlipHorizontal mirrors the image left-to-right. Block (bx, by) moves
+	// to (W-1-bx, by); coefficient (u, v) stays put and is negated if u is
+	// odd.
+	FlipHorizontal
+	// FlipVertical mirrors the image top-to-bottom. Block (bx, by) moves to
+	// (bx, H-1-by); coefficient (u, v) stays put and is negated if v is odd.
+	FlipVertical
+	// Transpose mirrors the image across its main diagonal. Block (bx, by)
+	// moves to (by, bx); coefficient (u, v) moves to (v, u). Sampling factors
+	// are swapped, so 4:2:2 becomes 4:4:0.
+	Transpose
+	// Transverse mirrors the image across its anti-diagonal. Block (bx, by)
+	// moves to (W-1-by, H-1-bx); coefficient (u, v) moves to (v, u) and is
+	// negated if u+v is odd.
+	Transverse
+	// Rotate90 rotates the image 90 degrees clockwise. Block (bx, by) moves
+	// to (W-1-by, bx); coefficient (u, v) moves to (v, u) and is negated if v
+	// is odd.
+	Rotate90
+	// Rotate180 rotates the image 180 degrees. Block (bx, by) moves to
+	// (W-1-bx, H-1-by); coefficient (u, v) stays put and is negated if u+v is
+	// odd.
+	Rotate180
+	// Rotate270 rotates the image 90 degrees counter-clockwise. Block (bx,
+	// by) moves to (by, H-1-bx); coefficient (u, v) moves to (v, u) and is
+	// negated if u is odd.
+	Rotate270
+)
+
+// decompose expresses op as a transposition followed by horizontal and
+// vertical flips.
+func (op Op) decompose() (transpose, flipH, flipV bool) {
+	switch op {
+	case FlipHorizontal:
+		return false, true, false
+	case FlipVertical:
+		return false, false, true
+	case Transpose:
+		return true, false, false
+	case Transverse:
+		return true, true, true
+	case Rotate90:
+		return true, true, false
+	case Rotate180:
+		return false, true, true
+	case Rotate270:
+		return true, false, true
+	}
+	return false, false, false
+}
+
+// TransformOptions are the parameters of a lossless transformation.
+type TransformOptions struct {
+	// Crop, if non-empty, is the region of the transformed image to keep.
+	// Its top-left corner is rounded down to the nearest MCU boundary, and
+	// it is clipped to the bounds of the transformed image.
+	Crop image.Rectangle
+	// PreservePayload causes the data hidden in the source image to be
+	// re-embedded in the transformed image, in the order expected by Reveal.
+	// If the image is cropped, any data that no longer fits is discarded.
+	PreservePayload bool
+}
+
+// ErrTransformTooSmall is returned if a transformation would leave no pixels
+// in the image.
+var ErrTransformTooSmall = errors.New("image is too small to transform")
+
+// Transform reads a baseline JPEG from r, applies op to its DCT coefficients,
+// and writes the result to w. Since the coefficients are never requantized,
+// the transformation introduces no additional loss. Default parameters are
+// used if a nil *TransformOptions is passed.
+//
+// Like jpegtran's -trim option, Transform discards any partial MCU at an edge
+// that would otherwise be mirrored into the interior of the image.
+func Transform(w io.Writer, r io.Reader, op Op, o *TransformOptions) error {
+	if o == nil {
+		o = &TransformOptions{}
+	}
+	src, data, err := readDCT(r)
+	if err != nil {
+		return err
+	}
+	if err := src.validate(); err != nil {
+		return err
+	}
+	dst, err := src.transform(op, o.Crop)
+	if err != nil {
+		return err
+	}
+	if o.PreservePayload {
+		dst.embed(data)
+	}
+
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	e.writeDCT(dst)
+	return e.err
+}
+
+// transform returns a copy of m with op applied and then cropped to crop.
+func (m *dctImage) transform(op Op, crop image.Rectangle) (*dctImage, error) {
+	transpose, flipH, flipV := op.decompose()
+	t := &dctImage{
+		width:               m.width,
+		height:              m.height,
+		nComp:               m.nComp,
+		comp:                m.comp,
+		quant:               m.quant,
+		ri:                  m.ri,
+		adobeTransformValid: m.adobeTransformValid,
+		adobeTransform:      m.adobeTransform,
+	}
+	if transpose {
+		t.width, t.height = m.height, m.width
+		for i := 0; i < t.nComp; i++ {
+			t.comp[i].h, t.comp[i].v = m.comp[i].v, m.comp[i].h
+		}
+		if t.nComp > 1 && t.comp[0].v == 4 {
+			return nil, errUnsupportedSubsamplingRatio
+		}
+		// The quantization tables must be transposed along with the
+		// coefficients.
+		var zig [blockSize]int
+		for i, n := range unzig {
+			zig[n] = i
+		}
+		for i := range t.quant {
+			for j, n := range unzig {
+				t.quant[i][zig[n%8*8+n/8]] = m.quant[i][j]
+			}
+		}
+	}
+
+	// Trim any partial MCU that would be mirrored.
+	mw, mh := 8*t.comp[0].h, 8*t.comp[0].v
+	if flipH {
+		t.width -= t.width % mw
+	}
+	if flipV {
+		t.height -= t.height % mh
+	}
+	// tw and th are the number of whole MCUs in the (trimmed) image, which
+	// are the extents that a flip mirrors across.
+	tw, th := t.width/mw, t.height/mh
+
+	// Apply the crop.
+	var x0, y0 int
+	if !crop.Empty() {
+		crop = crop.Intersect(image.Rect(0, 0, t.width, t.height))
+		x0, y0 = crop.Min.X/mw, crop.Min.Y/mh
+		t.width, t.height = crop.Max.X-x0*mw, crop.Max.Y-y0*mh
+	}
+	if t.width <= 0 || t.height <= 0 {
+		return nil, ErrTransformTooSmall
+	}
+
+	mxx, myy := t.mcus()
+	for i := 0; i < t.nComp; i++ {
+		hi, vi := t.comp[i].h, t.comp[i].v
+		srcStride := m.stride(i)
+		t.blocks[i] = make([]block, mxx*hi*myy*vi)
+		for by := 0; by < myy*vi; by++ {
+			for bx := 0; bx < mxx*hi; bx++ {
+				// Find the corresponding block in m by undoing the crop,
+				// the flips, and the transposition, in that order.
+				sx, sy := bx+x0*hi, by+y0*vi
+				if flipH {
+					sx = tw*hi - 1 - sx
+				}
+				if flipV {
+					sy = th*vi - 1 - sy
+				}
+				if transpose {
+					sx, sy = sy, sx
+				}
+				transformBlock(&t.blocks[i][by*mxx*hi+bx], &m.blocks[i][sy*srcStride+sx], transpose, flipH, flipV)
+			}
+		}
+	}
+	return t, nil
+}
+
+// transformBlock sets dst to src, transposed and then flipped as specified.
+// Both blocks are in natural (not zig-zag) order.
+func transformBlock(dst, src *block, transpose, flipH, flipV bool) {
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			x := src[8*v+u]
+			du, dv := u, v
+			if transpose {
+				du, dv = v, u
+			}
+			if flipH && du%2 == 1 {
+				x = -x
+			}
+			if flipV && dv%2 == 1 {
+				x = -x
+			}
+			dst[8*dv+du] = x
+		}
+	}
+}
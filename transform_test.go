@@ -0,0 +1,109 @@
+package jsteg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	orig, err := os.ReadFile("testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := jpeg.Decode(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []Op{Identity, FlipHorizontal, FlipVertical, Transpose, Transverse, Rotate90, Rotate180, Rotate270}
+	crops := []image.Rectangle{{}, image.Rect(20, 40, 90, 70)}
+	for _, op := range ops {
+		for _, crop := range crops {
+			var buf bytes.Buffer
+			if err := Transform(&buf, bytes.NewReader(orig), op, &TransformOptions{Crop: crop}); err != nil {
+				t.Fatal(err)
+			}
+			dst, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// map each pixel of dst back to src and compare luma
+			transpose, flipH, flipV := op.decompose()
+			sb := src.Bounds()
+			tw, th := sb.Dx(), sb.Dy()
+			if transpose {
+				tw, th = th, tw
+			}
+			if flipH {
+				tw -= tw % 16
+			}
+			if flipV {
+				th -= th % 16
+			}
+			x0, y0 := crop.Min.X/16*16, crop.Min.Y/16*16
+			var diff, n int
+			db := dst.Bounds()
+			for y := 0; y < db.Dy(); y++ {
+				for x := 0; x < db.Dx(); x++ {
+					sx, sy := x+x0, y+y0
+					if flipH {
+						sx = tw - 1 - sx
+					}
+					if flipV {
+						sy = th - 1 - sy
+					}
+					if transpose {
+						sx, sy = sy, sx
+					}
+					a := color.GrayModel.Convert(dst.At(x, y)).(color.Gray).Y
+					b := color.GrayModel.Convert(src.At(sx, sy)).(color.Gray).Y
+					if a > b {
+						diff += int(a - b)
+					} else {
+						diff += int(b - a)
+					}
+					n++
+				}
+			}
+			if diff > n {
+				t.Errorf("op %v, crop %v: transformed image differs from source (mean error %.2f)", op, crop, float64(diff)/float64(n))
+			}
+		}
+	}
+}
+
+func TestTransformPreservePayload(t *testing.T) {
+	f, err := os.Open("testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stego bytes.Buffer
+	data := []byte("foo bar baz quux")
+	if err := Hide(&stego, img, data, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []Op{Rotate90, FlipVertical, Transverse} {
+		var buf bytes.Buffer
+		err := Transform(&buf, bytes.NewReader(stego.Bytes()), op, &TransformOptions{PreservePayload: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revealed, err := Reveal(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(revealed, data) {
+			t.Errorf("op %v: revealed bytes do not match original", op)
+		}
+	}
+}
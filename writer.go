@@ -6,11 +6,14 @@ package jsteg
 
 import (
 	"bufio"
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"io"
+	"runtime"
 )
 
 // min returns the minimum of two integers.
@@ -21,6 +24,14 @@ func min(x, y int) int {
 	return y
 }
 
+// max returns the maximum of two integers.
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
 // div returns a/b rounded to the nearest integer, instead of rounded to zero.
 func div(a, b int32) int32 {
 	if a >= 0 {
@@ -227,9 +238,37 @@ type encoder struct {
 	bits, nBits uint32
 	// quant is the scaled quantization tables, in zig-zag order.
 	quant [nQuantIndex][blockSize]byte
+	// sub, ri, and metadata are the chroma subsampling ratio, restart
+	// interval, and metadata segments of the image.
+	sub      Subsampling
+	ri       int
+	metadata []Segment
 	// steganography
 	data    []byte
 	databit uint
+	stats   EmbedStats
+	// comps are the components that carry data, or 0 for just the luma.
+	comps Components
+	// sel selects the coefficients that carry data, or is nil for JSteg.
+	sel Selector
+	// perCoeff is the number of bits each usable coefficient carries, or 0
+	// for 1.
+	perCoeff int
+	// values, if non-nil, are the values of the usable coefficients chosen
+	// by an Embedder.
+	values []int32
+	// mask, if non-nil, marks the usable coefficients that carry data, in
+	// which case data holds the bit for each usable coefficient rather than
+	// the bits to embed in order.
+	mask []byte
+	// workers is the number of goroutines used to transform blocks.
+	workers int
+	// rows is a scratch buffer holding a row of MCUs.
+	rows []block
+	// ctx, if non-nil, is checked for cancellation after each row of MCUs,
+	// and progress, if non-nil, is called after each row.
+	ctx      context.Context
+	progress func(Progress)
 }
 
 func (e *encoder) flush() {
@@ -271,6 +310,16 @@ func (e *encoder) emit(bits, nBits uint32) {
 	e.bits, e.nBits = bits, nBits
 }
 
+// restart pads the current byte with 1's and writes the n'th RST marker,
+// modulo 8.
+func (e *encoder) restart(n int) {
+	if e.nBits > 0 {
+		e.emit(0xff>>e.nBits, 8-e.nBits)
+	}
+	e.writeByte(0xff)
+	e.writeByte(rst0Marker + uint8(n%8))
+}
+
 // emitHuff emits the given value with the given Huffman encoder.
 func (e *encoder) emitHuff(h huffIndex, value int32) {
 	x := theHuffmanLUT[h][value]
@@ -315,8 +364,9 @@ func (e *encoder) writeDQT() {
 	}
 }
 
-// writeSOF0 writes the Start Of Frame (Baseline Sequential) marker.
-func (e *encoder) writeSOF0(size image.Point, nComponent int) {
+// writeSOF0 writes the Start Of Frame (Baseline Sequential) marker. hv is the
+// sampling factors of the luma component of a color image.
+func (e *encoder) writeSOF0(size image.Point, nComponent int, hv uint8) {
 	markerlen := 8 + 3*nComponent
 	e.writeMarkerHeader(sof0Marker, markerlen)
 	e.buf[0] = 8 // 8-bit color.
@@ -333,8 +383,10 @@ func (e *encoder) writeSOF0(size image.Point, nComponent int) {
 	} else {
 		for i := 0; i < nComponent; i++ {
 			e.buf[3*i+6] = uint8(i + 1)
-			// We use 4:2:0 chroma subsampling.
-			e.buf[3*i+7] = "\x22\x11\x11"[i]
+			e.buf[3*i+7] = 0x11
+			if i == 0 {
+				e.buf[3*i+7] = hv
+			}
 			e.buf[3*i+8] = "\x00\x01\x01"[i]
 		}
 	}
@@ -353,43 +405,111 @@ func (e *encoder) writeDHT(nComponent int) {
 		markerlen += 1 + 16 + len(s.value)
 	}
 	e.writeMarkerHeader(dhtMarker, markerlen)
-	for i, s := range specs {
+	for i := range specs {
+		// Take the address of the spec, so that its count can be sliced
+		// without copying it to the heap.
+		s := &specs[i]
 		e.writeByte("\x00\x10\x01\x11"[i])
 		e.write(s.count[:])
 		e.write(s.value)
 	}
 }
 
-// writeBlock writes a block of pixel data using the given quantization table,
-// returning the post-quantized DC value of the DCT-transformed block. b is in
-// natural (not zig-zag) order.
-func (e *encoder) writeBlock(b *block, q quantIndex, prevDC int32) int32 {
-	fdct(b)
-	// Emit the DC delta.
-	dc := div(b[0], 8*int32(e.quant[q][0]))
-	e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
-	// Emit the AC components.
-	h, runLength := huffIndex(2*q+1), int32(0)
-	for zig := 1; zig < blockSize; zig++ {
-		ac := div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
-		// steganography
-		if len(e.data) > 0 && q == 0 && (ac < -1 || ac > 1) {
-			neg := ac < 0
-			if neg {
-				ac = -ac
+// quantize divides each coefficient of the DCT-transformed block b by the
+// given quantization table. b is in natural (not zig-zag) order.
+func (e *encoder) quantize(b *block, q quantIndex) {
+	for zig := 0; zig < blockSize; zig++ {
+		b[unzig[zig]] = div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+	}
+}
+
+// embed hides the next bits of e.data in the low bits of the magnitudes of
+// the quantized coefficients of b that e's Selector selects. b is a block of
+// component comp at position (bx, by). If e.mask is set, only the bits that
+// it marks are modified. If e.values is set, the selected coefficients are
+// replaced by the next of those values instead.
+func (e *encoder) embed(b *block, comp, bx, by int) {
+	sel := e.selector()
+	perCoeff := e.perCoeff
+	if perCoeff == 0 {
+		perCoeff = 1
+	}
+	for zig := 0; zig < blockSize; zig++ {
+		v := b[unzig[zig]]
+		if zig > 0 {
+			if v == 0 {
+				continue
 			}
-			// set LSB of ac using clear + or
-			ac = (ac &^ 1) | int32(e.data[0]>>e.databit)&1
-			if neg {
-				ac = -ac
+			e.stats.NonZero++
+		}
+		if !sel.Select(comp, zig, v, bx, by) {
+			continue
+		}
+		e.stats.Usable++
+		if e.values != nil {
+			if nv := e.values[e.stats.Usable-1]; nv != v {
+				e.stats.Changed++
+				b[unzig[zig]] = nv
 			}
-
-			// increment bit counter
-			if e.databit++; e.databit == 8 {
-				e.data = e.data[1:]
-				e.databit = 0
+			continue
+		}
+		mag := v
+		if mag < 0 {
+			mag = -mag
+		}
+		want := mag
+		for j := 0; j < perCoeff; j++ {
+			var bit int32
+			if e.mask != nil {
+				i := (e.stats.Usable-1)*perCoeff + j
+				if e.mask[i/8]>>(i%8)&1 == 0 {
+					continue
+				}
+				bit = int32(e.data[i/8]>>(i%8)) & 1
+			} else if len(e.data) == 0 {
+				break
+			} else {
+				bit = int32(e.data[0]>>e.databit) & 1
+				// increment bit counter
+				if e.databit++; e.databit == 8 {
+					e.data = e.data[1:]
+					e.databit = 0
+				}
 			}
+			// set bit j of want using clear + or
+			want = (want &^ (1 << j)) | bit<<j
+			e.stats.Embedded++
+		}
+		if want == mag {
+			continue
+		}
+		e.stats.Changed++
+		c, ok := nearestSelected(sel, comp, zig, v, want, perCoeff, bx, by)
+		if !ok && e.err == nil {
+			e.err = errUnembeddable
 		}
+		b[unzig[zig]] = c
+	}
+}
+
+// selector returns the Selector used by e.
+func (e *encoder) selector() Selector {
+	if e.sel == nil {
+		return JSteg
+	}
+	return e.sel
+}
+
+// emitBlock emits the quantized block b using the Huffman tables starting at
+// dcHuff, returning its DC value. b is in natural (not zig-zag) order.
+func (e *encoder) emitBlock(b *block, dcHuff huffIndex, prevDC int32) int32 {
+	// Emit the DC delta.
+	dc := b[0]
+	e.emitHuffRLE(dcHuff, 0, dc-prevDC)
+	// Emit the AC components.
+	h, runLength := dcHuff+1, int32(0)
+	for zig := 1; zig < blockSize; zig++ {
+		ac := b[unzig[zig]]
 		if ac == 0 {
 			runLength++
 		} else {
@@ -487,6 +607,19 @@ func yCbCrToYCbCr(m *image.YCbCr, p image.Point, yBlock, cbBlock, crBlock *block
 	}
 }
 
+// scale422 scales the 16x8 region represented by the first 2 src blocks to
+// the 8x8 dst block.
+func scale422(dst *block, src *[4]block) {
+	for i := 0; i < 2; i++ {
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 4; x++ {
+				j := 8*y + 2*x
+				dst[8*y+x+4*i] = (src[i][j] + src[i][j+1] + 1) >> 1
+			}
+		}
+	}
+}
+
 // scale scales the 16x16 region represented by the 4 src blocks to the 8x8
 // dst block.
 func scale(dst *block, src *[4]block) {
@@ -535,169 +668,464 @@ func (e *encoder) writeSOS(m image.Image) {
 	default:
 		e.write(sosHeaderYCbCr)
 	}
-	var (
-		// Scratch buffers to hold the YCbCr values.
-		// The blocks are in natural (not zig-zag) order.
-		b      block
-		cb, cr [4]block
-		// DC components are delta-encoded.
-		prevDCY, prevDCCb, prevDCCr int32
-	)
+	mcuW, mcuH, mcuBlocks, lumaBlocks := e.mcuLayout(m)
 	bounds := m.Bounds()
-	switch m := m.(type) {
-	case *image.Gray:
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
-				p := image.Pt(x, y)
-				grayToY(m, p, &b)
-				prevDCY = e.writeBlock(&b, 0, prevDCY)
+	rowBlocks := (bounds.Dx() + mcuW - 1) / mcuW * mcuBlocks
+	totalRows := (bounds.Dy() + mcuH - 1) / mcuH
+	totalMCUs := rowBlocks / mcuBlocks * totalRows
+	carry := e.carriers()
+	// DC components are delta-encoded, and reset at each restart marker.
+	var prevDC [3]int32
+	var n, row int
+	emitRow := func(blocks []block) {
+		for i := range blocks {
+			c, bx, by := blockPosition(i, row, mcuBlocks, lumaBlocks)
+			if carry[c] {
+				e.embed(&blocks[i], c, bx, by)
+			}
+			prevDC[c] = e.emitBlock(&blocks[i], huffIndex(2*min(c, 1)), prevDC[c])
+			if i%mcuBlocks != mcuBlocks-1 {
+				continue
+			}
+			if n++; e.ri > 0 && n%e.ri == 0 && n < totalMCUs {
+				e.restart(n/e.ri - 1)
+				prevDC = [3]int32{}
 			}
 		}
-	default:
-		rgba, _ := m.(*image.RGBA)
-		ycbcr, _ := m.(*image.YCbCr)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 16 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 16 {
-				for i := 0; i < 4; i++ {
-					xOff := (i & 1) * 8
-					yOff := (i & 2) * 4
-					p := image.Pt(x+xOff, y+yOff)
-					if rgba != nil {
-						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
-					} else if ycbcr != nil {
-						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
-					} else {
-						toYCbCr(m, p, &b, &cb[i], &cr[i])
-					}
-					prevDCY = e.writeBlock(&b, 0, prevDCY)
+		row++
+	}
+
+	if e.workers <= 1 {
+		if cap(e.rows) < rowBlocks {
+			e.rows = make([]block, rowBlocks)
+		}
+		blocks := e.rows[:rowBlocks]
+		for y, row := bounds.Min.Y, 1; y < bounds.Max.Y && e.err == nil; y, row = y+mcuH, row+1 {
+			e.mcuRow(m, y, blocks)
+			emitRow(blocks)
+			e.endRow(row, totalRows)
+		}
+	} else {
+		// Rows are transformed concurrently, but embedded and emitted in
+		// order. Each row in flight holds one of a fixed set of buffers, which
+		// bounds memory usage.
+		type job struct {
+			y      int
+			blocks []block
+			done   chan struct{}
+		}
+		free := make(chan []block, 2*e.workers)
+		for i := 0; i < cap(free); i++ {
+			free <- make([]block, rowBlocks)
+		}
+		jobs := make(chan job)
+		pending := make(chan job, cap(free))
+		// stop is closed if an error occurs, after which no more rows are
+		// started and the rows in flight are discarded.
+		stop := make(chan struct{})
+		go func() {
+			defer close(pending)
+			defer close(jobs)
+			for y := bounds.Min.Y; y < bounds.Max.Y; y += mcuH {
+				var blocks []block
+				select {
+				case blocks = <-free:
+				case <-stop:
+					return
+				}
+				j := job{y, blocks, make(chan struct{})}
+				pending <- j
+				jobs <- j
+			}
+		}()
+		for i := 0; i < e.workers; i++ {
+			go func() {
+				for j := range jobs {
+					e.mcuRow(m, j.y, j.blocks)
+					close(j.done)
+				}
+			}()
+		}
+		row := 0
+		for j := range pending {
+			<-j.done
+			if e.err == nil {
+				emitRow(j.blocks)
+				row++
+				e.endRow(row, totalRows)
+				if e.err != nil {
+					close(stop)
 				}
-				scale(&b, &cb)
-				prevDCCb = e.writeBlock(&b, 1, prevDCCb)
-				scale(&b, &cr)
-				prevDCCr = e.writeBlock(&b, 1, prevDCCr)
 			}
+			free <- j.blocks
 		}
 	}
 	// Pad the last byte with 1's.
 	e.emit(0x7f, 7)
 }
 
-// Capacity returns the number of bytes that can be hidden in m. Default
-// parameters are used if a nil *Options is passed.
-func Capacity(m image.Image, o *jpeg.Options) int {
-	bounds := m.Bounds()
-	if bounds.Dx() >= 1<<16 || bounds.Dy() >= 1<<16 {
-		return 0
+// mcuLayout returns the width and height of an MCU of m in pixels, the number
+// of blocks in it, and how many of those are luma blocks. A grayscale MCU is a
+// single 8x8 block; a color MCU is encoded as its Y blocks, then one Cb block
+// and one Cr block.
+func (e *encoder) mcuLayout(m image.Image) (w, h, blocks, lumaBlocks int) {
+	if _, ok := m.(*image.Gray); ok {
+		return 8, 8, 1, 1
 	}
-	quality := jpeg.DefaultQuality
-	if o != nil {
-		quality = o.Quality
-		if quality < 1 {
-			quality = 1
-		} else if quality > 100 {
-			quality = 100
-		}
+	switch e.sub {
+	case Subsampling422:
+		return 16, 8, 4, 2
+	case Subsampling444:
+		return 8, 8, 3, 1
 	}
-	var sf int
-	if quality < 50 {
-		sf = 5000 / quality
-	} else {
-		sf = 200 - quality*2
+	return 16, 16, 6, 4
+}
+
+// blockPosition returns the component of the i'th block in the given row of
+// MCUs, and the position of the block within that component, in blocks.
+func blockPosition(i, row, mcuBlocks, lumaBlocks int) (comp, bx, by int) {
+	mx, j := i/mcuBlocks, i%mcuBlocks
+	if j >= lumaBlocks {
+		return j - lumaBlocks + 1, mx, row
 	}
-	var lumQuant [blockSize]byte
-	for i := range lumQuant {
-		x := int(unscaledQuant[0][i])
-		x = (x*sf + 50) / 100
-		if x < 1 {
-			x = 1
-		} else if x > 255 {
-			x = 255
-		}
-		lumQuant[i] = uint8(x)
+	h := min(lumaBlocks, 2)
+	v := lumaBlocks / h
+	return 0, h*mx + j%h, v*row + j/h
+}
+
+// applyMask restricts e's Selector to the blocks of m allowed by mask.
+func (e *encoder) applyMask(m image.Image, mask BlockMask) {
+	mcuW, mcuH, _, lumaBlocks := e.mcuLayout(m)
+	b := m.Bounds()
+	mxx := (b.Dx() + mcuW - 1) / mcuW
+	myy := (b.Dy() + mcuH - 1) / mcuH
+	h := min(lumaBlocks, 2)
+	v := lumaBlocks / h
+	grid := [3]image.Point{image.Pt(mxx*h, myy*v)}
+	scale := [3]image.Point{image.Pt(1, 1)}
+	if _, ok := m.(*image.Gray); !ok {
+		grid[1], grid[2] = image.Pt(mxx, myy), image.Pt(mxx, myy)
+		scale[1], scale[2] = image.Pt(h, v), image.Pt(h, v)
 	}
+	e.sel = newMaskedSelector(e.selector(), mask, b.Dx(), b.Dy(), grid, scale)
+}
 
-	stegBits := func(b *block) (n int) {
-		for zig := 1; zig < blockSize; zig++ {
-			if ac := div(b[unzig[zig]], 8*int32(lumQuant[zig])); ac < -1 || ac > 1 {
-				n++
-			}
-		}
-		return
+// carriers reports which components carry data.
+func (e *encoder) carriers() (carry [3]bool) {
+	comps := e.comps
+	if comps == 0 {
+		comps = ComponentY
 	}
+	for c := range carry {
+		carry[c] = comps&(1<<c) != 0
+	}
+	return carry
+}
 
-	var numBits int
-	var b block
-	var cb, cr [4]block
+// endRow is called after each row of MCUs is emitted. It reports the
+// encoder's progress, and stops it if its context is done.
+func (e *encoder) endRow(rows, totalRows int) {
+	if e.progress != nil {
+		e.progress(Progress{Rows: rows, TotalRows: totalRows, Bits: e.stats.Embedded})
+	}
+	if e.ctx != nil && e.err == nil {
+		e.err = e.ctx.Err()
+	}
+}
+
+// mcuRow sets blocks to the quantized blocks of the row of MCUs starting at
+// y, in the order that they are emitted. It is safe to call concurrently.
+func (e *encoder) mcuRow(m image.Image, y int, blocks []block) {
+	bounds := m.Bounds()
 	switch m := m.(type) {
 	case *image.Gray:
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
-				p := image.Pt(x, y)
-				grayToY(m, p, &b)
-				fdct(&b)
-				numBits += stegBits(&b)
-			}
+		for i, x := 0, bounds.Min.X; x < bounds.Max.X; i, x = i+1, x+8 {
+			b := &blocks[i]
+			grayToY(m, image.Pt(x, y), b)
+			fdct(b)
+			e.quantize(b, quantIndexLuminance)
 		}
 	default:
 		rgba, _ := m.(*image.RGBA)
 		ycbcr, _ := m.(*image.YCbCr)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 16 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 16 {
-				for i := 0; i < 4; i++ {
-					xOff := (i & 1) * 8
-					yOff := (i & 2) * 4
-					p := image.Pt(x+xOff, y+yOff)
-					if rgba != nil {
-						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
-					} else if ycbcr != nil {
-						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
-					} else {
-						toYCbCr(m, p, &b, &cb[i], &cr[i])
-					}
-					fdct(&b)
-					numBits += stegBits(&b)
+		mcuW, _, mcuBlocks, lumaBlocks := e.mcuLayout(m)
+		// Scratch buffers to hold the chroma values before subsampling.
+		// The blocks are in natural (not zig-zag) order.
+		var cb, cr [4]block
+		for j, x := 0, bounds.Min.X; x < bounds.Max.X; j, x = j+mcuBlocks, x+mcuW {
+			mcu := blocks[j : j+mcuBlocks]
+			for i := 0; i < lumaBlocks; i++ {
+				xOff := (i & 1) * 8
+				yOff := (i & 2) * 4
+				p := image.Pt(x+xOff, y+yOff)
+				if rgba != nil {
+					rgbaToYCbCr(rgba, p, &mcu[i], &cb[i], &cr[i])
+				} else if ycbcr != nil {
+					yCbCrToYCbCr(ycbcr, p, &mcu[i], &cb[i], &cr[i])
+				} else {
+					toYCbCr(m, p, &mcu[i], &cb[i], &cr[i])
 				}
-				scale(&b, &cb)
-				fdct(&b)
-				scale(&b, &cr)
-				fdct(&b)
+				fdct(&mcu[i])
+				e.quantize(&mcu[i], quantIndexLuminance)
+			}
+			cbBlock, crBlock := &mcu[lumaBlocks], &mcu[lumaBlocks+1]
+			switch lumaBlocks {
+			case 4:
+				scale(cbBlock, &cb)
+				scale(crBlock, &cr)
+			case 2:
+				scale422(cbBlock, &cb)
+				scale422(crBlock, &cr)
+			default:
+				*cbBlock, *crBlock = cb[0], cr[0]
 			}
+			fdct(cbBlock)
+			e.quantize(cbBlock, quantIndexChrominance)
+			fdct(crBlock)
+			e.quantize(crBlock, quantIndexChrominance)
 		}
 	}
+}
+
+// Capacity returns the number of bytes that can be hidden in m by Hide.
+// Default parameters are used if a nil *jpeg.Options is passed.
+func Capacity(m image.Image, o *jpeg.Options) int {
+	return CapacityWithOptions(m, FromJPEGOptions(o))
+}
+
+// CapacityWithOptions returns the number of bytes that can be hidden in m by
+// HideWithOptions. Default parameters are used if a nil *Options is passed.
+// With an Embedder, it is the capacity of LSB replacement, one bit per
+// coefficient. The overhead of the Codecs and SigningKey of o is subtracted,
+// assuming that Flate cannot compress the data; that of Codecs other than the
+// built-in ones is not.
+func CapacityWithOptions(m image.Image, o *Options) int {
+	if o == nil {
+		o = &Options{}
+	}
+	bounds := m.Bounds()
+	if bounds.Dx() >= 1<<16 || bounds.Dy() >= 1<<16 || o.validate() != nil {
+		return 0
+	}
+	var e encoder
+	e.setOptions(o)
+	if o.Mask != nil {
+		e.applyMask(m, o.Mask)
+	}
+	n := e.usable(m) * e.perCoeff / 8
+	if o.SigningKey != nil {
+		n = max(n-signedHeaderSize-ed25519.SignatureSize, 0)
+	}
+	if len(o.Codecs) > 0 {
+		n = payloadCapacity(n, o.Codecs)
+	}
+	return n
+}
+
+// usable returns the number of coefficients of m that can carry data.
+func (e *encoder) usable(m image.Image) int {
+	var n int
+	e.forEachSelected(m, func(comp, zig int, v int32, bx, by int) { n++ })
+	return n
+}
 
-	return numBits / 8
+// stream returns the coefficients of m that can carry data.
+func (e *encoder) stream(m image.Image) *CoefficientStream {
+	s := &CoefficientStream{sel: e.selector()}
+	e.forEachSelected(m, func(comp, zig int, v int32, bx, by int) {
+		q := quantIndexLuminance
+		if comp > 0 {
+			q = quantIndexChrominance
+		}
+		s.Values = append(s.Values, v)
+		s.Costs = append(s.Costs, float64(e.quant[q][zig]))
+		s.pos = append(s.pos, coeffPos{uint8(comp), uint8(zig), int32(bx), int32(by)})
+	})
+	return s
+}
+
+// forEachSelected calls fn on each coefficient of m that can carry data, in
+// the order that they are embedded.
+func (e *encoder) forEachSelected(m image.Image, fn func(comp, zig int, v int32, bx, by int)) {
+	mcuW, mcuH, mcuBlocks, lumaBlocks := e.mcuLayout(m)
+	bounds := m.Bounds()
+	rowBlocks := (bounds.Dx() + mcuW - 1) / mcuW * mcuBlocks
+	if cap(e.rows) < rowBlocks {
+		e.rows = make([]block, rowBlocks)
+	}
+	blocks := e.rows[:rowBlocks]
+	carry := e.carriers()
+	sel := e.selector()
+	for y, row := bounds.Min.Y, 0; y < bounds.Max.Y; y, row = y+mcuH, row+1 {
+		e.mcuRow(m, y, blocks)
+		for i := range blocks {
+			c, bx, by := blockPosition(i, row, mcuBlocks, lumaBlocks)
+			if !carry[c] {
+				continue
+			}
+			for zig := 0; zig < blockSize; zig++ {
+				v := blocks[i][unzig[zig]]
+				if (zig == 0 || v != 0) && sel.Select(c, zig, v, bx, by) {
+					fn(c, zig, v, bx, by)
+				}
+			}
+		}
+	}
 }
 
 // ErrTooSmall is returned if the image is too small to hold the requested
 // payload.
 var ErrTooSmall = errors.New("image is too small to hold the requested payload")
 
+// EmbedStats describes the AC coefficients of the components of an image
+// written by HideStats that carry data.
+type EmbedStats struct {
+	// NonZero is the number of non-zero coefficients.
+	NonZero int
+	// Usable is the number of coefficients that can carry data. Each one
+	// carries Options.BitsPerCoefficient bits, so with the default of 1 it is
+	// the capacity of the image in bits.
+	Usable int
+	// Embedded is the number of bits of data that were hidden.
+	Embedded int
+	// Changed is the number of coefficients whose value was modified by
+	// embedding. With one bit per coefficient, it is on average half of
+	// Embedded.
+	Changed int
+}
+
 // Hide writes the Image m to w in JPEG 4:2:0 baseline format with the given
 // options, hiding the bits of data in the LSB of each block. Default
-// parameters are used if a nil *Options is passed.
+// parameters are used if a nil *jpeg.Options is passed. HideWithOptions
+// accepts the steganography settings of Options as well.
 func Hide(w io.Writer, m image.Image, data []byte, o *jpeg.Options) error {
-	b := m.Bounds()
-	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
-		return errors.New("jpeg: image is too large to encode")
+	return HideWithOptions(w, m, data, FromJPEGOptions(o))
+}
+
+// HideWithOptions is like Hide, but takes an *Options, which adds
+// steganography settings to the JPEG quality. Default parameters are used if
+// a nil *Options is passed.
+func HideWithOptions(w io.Writer, m image.Image, data []byte, o *Options) error {
+	_, err := HideStats(w, m, data, o)
+	return err
+}
+
+// HideStats is like HideWithOptions, but also reports statistics about the
+// embedding.
+func HideStats(w io.Writer, m image.Image, data []byte, o *Options) (EmbedStats, error) {
+	return hide(w, m, data, o, 1)
+}
+
+// HideParallel is like HideWithOptions, but performs color conversion, the
+// DCT, and quantization on the given number of goroutines, each processing a
+// row of MCUs at a time. If workers is not positive, runtime.GOMAXPROCS(0)
+// is used. Embedding and Huffman encoding remain sequential, so the output is
+// identical to that of HideWithOptions.
+func HideParallel(w io.Writer, m image.Image, data []byte, o *Options, workers int) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
 	}
+	_, err := hide(w, m, data, o, workers)
+	return err
+}
+
+func hide(w io.Writer, m image.Image, data []byte, o *Options, workers int) (EmbedStats, error) {
 	var e encoder
-	e.data = data
+	e.workers = workers
 	if ww, ok := w.(writer); ok {
 		e.w = ww
 	} else {
 		e.w = bufio.NewWriter(w)
 	}
-	// Clip quality to [1, 100].
-	quality := jpeg.DefaultQuality
-	if o != nil {
-		quality = o.Quality
-		if quality < 1 {
-			quality = 1
-		} else if quality > 100 {
-			quality = 100
+	return e.hide(m, data, o)
+}
+
+// hide writes m to e.w, hiding data. e must be freshly initialized.
+func (e *encoder) hide(m image.Image, data []byte, o *Options) (EmbedStats, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	b := m.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return EmbedStats{}, errors.New("jpeg: image is too large to encode")
+	}
+	if err := o.validate(); err != nil {
+		return EmbedStats{}, err
+	}
+	e.setOptions(o)
+	if o.Mask != nil {
+		e.applyMask(m, o.Mask)
+	}
+	if len(o.Codecs) > 0 {
+		var err error
+		if data, err = encodePayload(data, o.Codecs); err != nil {
+			return EmbedStats{}, err
+		}
+	}
+	if o.SigningKey != nil {
+		var err error
+		if data, err = signPayload(data, o.SigningKey, b.Dx(), b.Dy()); err != nil {
+			return EmbedStats{}, err
+		}
+	}
+	if o.Embedder != nil {
+		if err := e.embedStream(m, data, o); err != nil {
+			return EmbedStats{}, err
+		}
+	} else if len(o.Key) > 0 {
+		n := e.usable(m) * e.perCoeff
+		if 8*len(data) > n {
+			return EmbedStats{}, ErrTooSmall
+		}
+		e.data, e.mask = scatter(data, o.Key, n)
+	} else {
+		e.data = data
+	}
+	err := e.writeImage(m)
+	return e.stats, err
+}
+
+// embedStream has o.Embedder choose the values of the coefficients of m that
+// carry data, which writeImage then substitutes.
+func (e *encoder) embedStream(m image.Image, data []byte, o *Options) error {
+	s := e.stream(m)
+	var perm []int32
+	if len(o.Key) > 0 {
+		perm = keyedOrder(o.Key, len(s.Values), len(s.Values))
+		p := &CoefficientStream{sel: s.sel}
+		for _, i := range perm {
+			p.Values = append(p.Values, s.Values[i])
+			p.Costs = append(p.Costs, s.Costs[i])
+			p.pos = append(p.pos, s.pos[i])
+		}
+		s = p
+	}
+	values, err := o.Embedder.Embed(s, data)
+	if err != nil {
+		return err
+	} else if len(values) != len(s.Values) {
+		return errors.New("jsteg: embedder returned the wrong number of coefficients")
+	}
+	for _, v := range values {
+		if v < -1023 || v > 1023 {
+			return errors.New("jsteg: embedder returned a coefficient out of range")
 		}
 	}
+	e.values = values
+	if perm != nil {
+		e.values = make([]int32, len(values))
+		for k, i := range perm {
+			e.values[i] = values[k]
+		}
+	}
+	e.stats.Embedded = 8 * len(data)
+	return nil
+}
+
+// setOptions configures e according to o, which must be valid.
+func (e *encoder) setOptions(o *Options) {
 	// Convert from a quality rating to a scaling factor.
+	quality := o.quality()
 	var scale int
 	if quality < 50 {
 		scale = 5000 / quality
@@ -717,6 +1145,17 @@ func Hide(w io.Writer, m image.Image, data []byte, o *jpeg.Options) error {
 			e.quant[i][j] = uint8(x)
 		}
 	}
+	e.comps = o.components()
+	e.sel = o.Selector
+	e.perCoeff = o.bitsPerCoefficient()
+	e.sub = o.Subsampling
+	e.ri = o.RestartInterval
+	e.metadata = o.Metadata
+}
+
+// writeImage writes m to e in JPEG baseline format, using the quantization
+// tables, subsampling, restart interval, and metadata of e, and hiding e.data.
+func (e *encoder) writeImage(m image.Image) error {
 	// Compute number of components based on input image type.
 	nComponent := 3
 	switch m.(type) {
@@ -727,15 +1166,28 @@ func Hide(w io.Writer, m image.Image, data []byte, o *jpeg.Options) error {
 	e.buf[0] = 0xff
 	e.buf[1] = 0xd8
 	e.write(e.buf[:2])
+	// Write the metadata.
+	for _, s := range e.metadata {
+		e.writeMarkerHeader(s.Marker, 2+len(s.Data))
+		e.write(s.Data)
+	}
 	// Write the quantization tables.
 	e.writeDQT()
 	// Write the image dimensions.
-	e.writeSOF0(b.Size(), nComponent)
+	e.writeSOF0(m.Bounds().Size(), nComponent, "\x22\x21\x11"[e.sub])
 	// Write the Huffman tables.
 	e.writeDHT(nComponent)
+	// Write the restart interval.
+	if e.ri > 0 {
+		e.writeMarkerHeader(driMarker, 4)
+		e.writeByte(uint8(e.ri >> 8))
+		e.writeByte(uint8(e.ri))
+	}
 	// Write the image data.
 	e.writeSOS(m)
-	if len(e.data) > 0 {
+	if e.err != nil {
+		return e.err
+	} else if e.mask == nil && len(e.data) > 0 {
 		return ErrTooSmall
 	}
 	// Write the End Of Image marker.